@@ -0,0 +1,144 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A job pauses itself if too many files fail, or too many edits make a
+// large change to the date, since both suggest a wrong parameter. The
+// user can check the edits so far and resume the job, or stop it.
+
+// Limits for pausing a job. Zero means no limit.
+type breakerLimits struct {
+	maxFailures int           // Failed files before pausing.
+	maxShift    time.Duration // Largest expected change to a date.
+	maxShifted  int           // Edits changing a date by more than maxShift before pausing.
+}
+
+const (
+	defaultMaxFailures = 10
+	defaultMaxShift    = 12 * time.Hour
+	defaultMaxShifted  = 5
+)
+
+// Read a non-negative count from a form field, with a default if it's
+// empty.
+func countParam(name string, def int, r *http.Request) (int, error) {
+	param := trimmedField(name, r)
+	if param == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n < 0 {
+		return 0, errors.New("Expected a number that's zero or more for " + name + ".")
+	}
+	return n, nil
+}
+
+func breakerParam(r *http.Request) (breakerLimits, error) {
+	var limits breakerLimits
+	var err error
+	if limits.maxFailures, err = countParam("maxfailures", defaultMaxFailures, r); err != nil {
+		return limits, err
+	}
+	hours, err := countParam("maxshift", int(defaultMaxShift/time.Hour), r)
+	if err != nil {
+		return limits, err
+	}
+	limits.maxShift = time.Duration(hours) * time.Hour
+	if limits.maxShifted, err = countParam("maxshifted", defaultMaxShifted, r); err != nil {
+		return limits, err
+	}
+	return limits, nil
+}
+
+func isFailure(o outcome) bool {
+	switch o {
+	case outcomeEdited, outcomeUnchanged, outcomeReported, outcomeExcluded, outcomeFiltered, outcomeSkipped, outcomeImplausible:
+		return false
+	}
+	return true
+}
+
+// Count an edit that changed a date in the page, if it made a large
+// change.
+func (j *job) shifted(result editResult) {
+	shift := result.shift
+	if shift < 0 {
+		shift = -shift
+	}
+	if j.breaker.maxShift > 0 && shift > j.breaker.maxShift {
+		j.largeShifts++
+	}
+}
+
+// Pause the job if it has reached a limit, until the user resumes it.
+// Returns false if the job was stopped instead.
+func (j *job) checkBreaker() bool {
+	limits := j.breaker
+	var reason string
+	switch {
+	case limits.maxFailures > 0 && j.failures >= limits.maxFailures:
+		reason = fmt.Sprintf("%d files failed", j.failures)
+	case limits.maxShifted > 0 && j.largeShifts >= limits.maxShifted:
+		reason = fmt.Sprintf("%d edits changed the date by more than %d hours", j.largeShifts, int(limits.maxShift/time.Hour))
+	default:
+		return true
+	}
+	writeString(j.w, "</p>\n<p><b>Job paused: "+reason+".</b> Check the output and edits so far, then resume the job, or stop it by pressing the browser stop button.</p>\n")
+	writeString(j.w, `<form action="`+resumeRelative+`" method="post" target="_blank"><input type="hidden" name="job" value="`+strconv.Itoa(j.status.id)+`"><input type="submit" value="Resume"></form>
+<p>`)
+	j.flusher.Flush()
+	resume := editScheduler.pauseJob(j.status)
+	select {
+	case <-resume:
+	case <-j.ctx.Done():
+		return false
+	}
+	j.failures, j.largeShifts = 0, 0
+	return writeString(j.w, "Resumed.<br>\n") == nil
+}
+
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+	title := "dtz resume"
+	err := r.ParseForm()
+	if err != nil {
+		preError(w, title, err)
+		return
+	}
+	id, err := strconv.Atoi(trimmedField("job", r))
+	if err != nil {
+		preMessage(w, title, "Job number not given.")
+		return
+	}
+	accessToken, err := r.Cookie(tokenCookie)
+	if err != nil {
+		preMessage(w, title, "Cookie "+tokenCookie+" not set for OAuth.")
+		return
+	}
+	accessSecret, err := r.Cookie(secretCookie)
+	if err != nil {
+		preMessage(w, title, "Cookie "+secretCookie+" not set for OAuth.")
+		return
+	}
+	client, err := mwclient.New(commonsPrefix+"w/api.php", "dtz; User:Ghouston")
+	if err != nil {
+		preError(w, title, err)
+		return
+	}
+	user, err := authClient(client, accessToken.Value, accessSecret.Value)
+	if err != nil {
+		preError(w, title, err)
+		return
+	}
+	if err := editScheduler.resumeJob(id, user.name); err != nil {
+		preError(w, title, err)
+		return
+	}
+	preMessage(w, title, "Job "+strconv.Itoa(id)+" resumed by "+user.name+".")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// A typo in a file name or search can select far more files than
+// intended, so if a job selects more than confirmThreshold uploads, the
+// count and the span of upload dates are shown and must be confirmed
+// before any edits are made. The number of search results is always
+// shown for confirmation, since a search is easily broader than it
+// looks. The threshold may be set with the ConfirmThreshold environment
+// variable.
+var confirmThreshold = 500
+
+func loadConfirmThreshold() error {
+	config := os.Getenv("ConfirmThreshold")
+	if config == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(config)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid ConfirmThreshold %s.", strconv.Quote(config))
+	}
+	confirmThreshold = n
+	return nil
+}
+
+// The number of uploads selected, and the upload times of the first
+// and last in API format.
+type uploadCount struct {
+	files       int
+	first, last string
+}
+
+func countUploads(ranges []uploadRange, client *mwclient.Client) (uploadCount, error) {
+	var count uploadCount
+	for _, r := range ranges {
+		params := params.Values{
+			"list":    "allimages",
+			"aiuser":  r.user,
+			"aisort":  "timestamp",
+			"aidir":   "ascending",
+			"aiprop":  "timestamp",
+			"ailimit": "max",
+		}
+		if r.start != "" {
+			params["aistart"] = r.start
+		}
+		if r.end != "" {
+			params["aiend"] = r.end
+		}
+		query := client.NewQuery(params)
+		for query.Next() {
+			images, err := query.Resp().GetObjectArray("query", "allimages")
+			if err != nil {
+				return count, err
+			}
+			for _, image := range images {
+				timestamp, err := image.GetString("timestamp")
+				if err != nil {
+					return count, err
+				}
+				count.files++
+				if count.first == "" || timestamp < count.first {
+					count.first = timestamp
+				}
+				if timestamp > count.last {
+					count.last = timestamp
+				}
+			}
+		}
+		if query.Err() != nil {
+			return count, query.Err()
+		}
+	}
+	return count, nil
+}
+
+// Check whether the uploads selected by ranges need confirming, and if
+// so, write a page asking for it. Returns true if the job can go ahead.
+func confirmUploads(w http.ResponseWriter, r *http.Request, title string, ranges []uploadRange, client *mwclient.Client) bool {
+	if trimmedField("confirmed", r) != "" {
+		return true
+	}
+	count, err := countUploads(ranges, client)
+	if err != nil {
+		preError(w, title, err)
+		return false
+	}
+	if count.files == 0 {
+		preMessage(w, title, "No uploads were selected.")
+		return false
+	}
+	if count.files <= confirmThreshold {
+		return true
+	}
+	writeConfirmation(w, r, title, fmt.Sprintf("%d files are selected, uploaded from %s to %s.", count.files, count.first, count.last), count.files)
+	return false
+}
+
+// Check whether the results of a search have been confirmed, and if
+// not, write a page asking for it. Returns true if the job can go ahead.
+func confirmSearch(w http.ResponseWriter, r *http.Request, title, search string, total int64) bool {
+	if total == 0 {
+		preMessage(w, title, "The search found no files.")
+		return false
+	}
+	if trimmedField("confirmed", r) != "" {
+		return true
+	}
+	writeConfirmation(w, r, title, fmt.Sprintf("The search %s found %d files.", strconv.Quote(search), total), int(total))
+	return false
+}
+
+// Write a page describing the files selected, with a form that repeats
+// the request with confirmation.
+func writeConfirmation(w http.ResponseWriter, r *http.Request, title, description string, files int) {
+	writeHead(w, title)
+	writeString(w, "<body>\n")
+	writeString(w, "<p>"+html.EscapeString(description)+" Please check that this is intended before continuing.</p>\n")
+	writeString(w, `<form action="`+outputRelative+`" method="post">
+`)
+	names := make([]string, 0, len(r.PostForm))
+	for name := range r.PostForm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.PostForm[name] {
+			writeString(w, `<input type="hidden" name="`+html.EscapeString(name)+`" value="`+html.EscapeString(value)+`">
+`)
+		}
+	}
+	writeString(w, `<input type="hidden" name="confirmed" value="1">
+<input type="submit" value="Process `+strconv.Itoa(files)+` files">
+</form></body></html>`)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConfirmSearch(t *testing.T) {
+	tests := []struct {
+		total     int64
+		confirmed bool
+		want      bool
+		page      string // Expected in the page written, if any.
+	}{
+		{0, false, false, "no files"},
+		{0, true, false, "no files"},
+		{3, false, false, "found 3 files"},
+		{int64(confirmThreshold) + 1, false, false, "Process"},
+		{3, true, true, ""},
+	}
+	for _, test := range tests {
+		form := url.Values{"select": {selectSearch}, "search": {"insource:Canon"}}
+		if test.confirmed {
+			form.Set("confirmed", "1")
+		}
+		r := testRequest(form)
+		r.PostForm = form
+		w := httptest.NewRecorder()
+		if got := confirmSearch(w, r, "dtz", "insource:Canon", test.total); got != test.want {
+			t.Errorf("confirmSearch with %d results (confirmed %v) = %v, want %v", test.total, test.confirmed, got, test.want)
+		}
+		if !strings.Contains(w.Body.String(), test.page) {
+			t.Errorf("confirmSearch with %d results wrote %q, want it to contain %q", test.total, w.Body.String(), test.page)
+		}
+	}
+}
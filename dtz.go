@@ -3,6 +3,7 @@ package main
 import (
 	mwclient "cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -20,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 func writeString(w io.Writer, s string) error {
@@ -65,12 +67,18 @@ const toolRelative = "/"
 const outputRelative = toolRelative + "output"
 const authRelative = toolRelative + "auth"
 const logoutRelative = toolRelative + "logout"
+const statusRelative = toolRelative + "status"
+const resumeRelative = toolRelative + "resume"
 const tokenCookie = "dtz_token"
 const secretCookie = "dtz_secret"
 
 // Immutable once loaded in main().
 var privateKey *rsa.PrivateKey
 
+// A change tag registered on Commons, applied to every edit if set in
+// the environment.
+var changeTag = os.Getenv("ChangeTag")
+
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	title := "dtz"
 	err := r.ParseForm()
@@ -101,6 +109,8 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	writeLink(w, gitURL, "source code at github")
 	writeString(w, "\n&mdash; ")
 	writeLink(w, talkURL, "author's talk page")
+	writeString(w, "\n&mdash; ")
+	writeLink(w, statusRelative, "running jobs")
 	writeString(w, ".</p>\n")
 	if _, err := r.Cookie(tokenCookie); err == nil {
 		writeString(w, "<p>OAuth appears to be enabled. ")
@@ -133,15 +143,107 @@ Location timezone <input type="text" name="location" size="50"></p>
 <p>Either a single file or a range of files can be edited. A range is obtained by using the upload order
 from the relevant user on Commons between the two specified files. The order doesn't matter. Note that if
 multiple files have the same upload timestamp as either the first or last file, all will be processed.</p>
-<p>First file in range <input type="text" name="first" size="60"><br>
-Last file in range <input type="text" name="last" size="60"></p>
-<p>If filters are specified, files will only be processed if the text appears as a substring in either the wiki
-source of the author field, or in the camera model in Exif. The matching is case insensitive. Only the first
-line of the author field is examined.</p>
-<p>Author filter <input type="text" name="author" size="50"><br>
-Camera model filter <input type="text" name="model" size="50"></p>
-<p>After pressing Submit, it may take some time before output appears. Edits are limited to one per five seconds,
-and can be examined in real-time at your contributions page at Commons. If you need to stop the tool, press the
+<p><input type="radio" name="select" value="range" checked> Select a range of uploads<br>
+First file in range <input type="text" name="first" size="60"><br>
+Last file in range <input type="text" name="last" size="60"><br>
+More ranges can be given one per line, as first and last files separated by "|", optionally followed by
+camera and location timezones that apply only to that range, e.g., "IMG_0001.JPG | IMG_0050.JPG | 1000". As
+above, a single timezone is used for both.<br>
+<textarea name="ranges" rows="4" cols="60"></textarea></p>
+<p>A range of uploads can also be specified by the uploader and upload times, in UTC, in the format
+"2023-03-01" or "2023-03-01 14:30". An end date without a time includes the whole day.</p>
+<p>Only your own uploads are edited, unless you're a member of a group allowed to edit other users' uploads,
+such as administrators and file movers. Edits to other users' uploads are noted in the edit summary.</p>
+<p><input type="radio" name="select" value="uploads"> Select uploads by time<br>
+Uploader <input type="text" name="uploader" size="50"> (leave empty for your own uploads)<br>
+Uploaded from <input type="text" name="start" size="20">
+to <input type="text" name="end" size="20"></p>
+<p>Files can also be limited to those taken in a time window, according to the camera's clock, in the same
+formats. If a time window is given, the upload times can be omitted to scan all of a user's uploads.</p>
+<p>Taken from <input type="text" name="takenfrom" size="20">
+to <input type="text" name="takento" size="20"></p>
+<p>Alternatively, the files in a category can be edited, optionally including its subcategories to the given
+depth.</p>
+<p><input type="radio" name="select" value="category"> Select files in a category<br>
+Category <input type="text" name="category" size="60"><br>
+Subcategory depth <input type="text" name="depth" size="5" value="0"></p>
+<p>Or a list of files can be given, with one file name or Commons URL per line. The files are processed in the
+order given.</p>
+<p><input type="radio" name="select" value="list"> Select a list of files<br>
+<textarea name="titles" rows="10" cols="60"></textarea></p>
+<p>Or all the files used on a page, such as a gallery, can be edited. The page can be on Commons, or on another
+Wikimedia wiki if given as a URL.</p>
+<p><input type="radio" name="select" value="page"> Select files used on a page<br>
+Page title or URL <input type="text" name="page" size="60"></p>
+<p>Or files can be found with a search query, such as <code>incategory:"Trip 2019" insource:"Canon EOS"</code>.
+Searches are limited to the File namespace, and at most 10,000 results can be processed. The number of files found
+is shown for confirmation before any edits are made.</p>
+<p><input type="radio" name="select" value="search"> Select files with a search<br>
+Search query <input type="text" name="search" size="60"></p>
+<p>If an author filter is specified, files will only be processed if it matches the wiki source of the author
+field. Only the first line of the author field is examined. Alternatively, the filter can be matched against
+the targets of links in the author field, such as "User:Example" for [[User:Example|Example]], and User:
+templates. A link filter matches if any link matches, or with "not" checked, if none do.</p>
+<p>
+`)
+	writeFilterInputs(w, "Author filter", "author")
+	writeString(w, `<input type="checkbox" name="authorlinks" value="1"> Match link targets in the author field</p>
+<p>Files can also be filtered by fields in Exif, e.g., to select one camera by its serial number when two
+photographers used the same model. Contains and equals are case insensitive. If "not" is checked, only files
+that don't match are processed.</p>
+<p>
+`)
+	for _, f := range exifFilterFields {
+		writeFilterInputs(w, strings.ToUpper(f.label[:1])+f.label[1:], f.name)
+	}
+	writeString(w, `</p>
+<p>To avoid losing corrections made by hand, a date will only be replaced if it's empty, the unmodified time
+from Exif, an {{According to Exif data}} template or an existing {{DTZ}} template. Other dates are reported as
+curated and skipped, unless the following is checked.</p>
+<p><input type="checkbox" name="overwrite" value="1"> Replace curated dates, and existing inception statements</p>
+<p>Existing {{DTZ}} dates are recalculated, and the output reports whether the offset, the wall time or both
+were changed. To correct a previous run with the wrong timezone, dates can be restricted to existing {{DTZ}}
+values with a different offset.</p>
+<p><input type="checkbox" name="offsetonly" value="1"> Only fix {{DTZ}} dates with a different offset</p>
+<p>For files without Exif data, such as scans, the date can instead be taken from the existing date field, if it's
+in an ISO format such as "2012-06-03 14:22" or uses the {{Date}} or {{Taken on}} templates. The existing date
+is assumed to be the wall time in the camera timezone.</p>
+<p><input type="radio" name="source" value="exif" checked> Take dates from Exif<br>
+<input type="radio" name="source" value="wikitext"> Take dates from the existing date field</p>
+<p>The date can also be set as the inception (P571) statement in the structured data of each file. Structured
+data only supports dates to the precision of a day. Existing inception statements with another value are left
+alone, unless replacing curated dates.</p>
+<p><input type="checkbox" name="inception" value="1"> Also set inception in structured data</p>
+<p>Alternatively, the wikitext can be left alone, and the existing inception statements compared with the
+dates from Exif. Missing or disagreeing statements are reported and, unless only reporting, fixed.</p>
+<p><input type="checkbox" name="inceptiononly" value="1"> Only check inception, without editing the wikitext<br>
+<input type="checkbox" name="reportonly" value="1"> Only report inception disagreements</p>
+<p>The edit summary can use $action for a description of the edit, $camera and $location for the timezones,
+$offset for the offset applied to the camera's time, $source for where the date was taken from, and $job for
+a link to the tool with the job's number and start time.<br>
+<input type="text" name="summary" size="80" value="`+html.EscapeString(defaultSummary)+`"><br>
+<input type="checkbox" name="minor" value="1"> Mark edits as minor</p>
+<p>Exif times that are probably wrong, e.g., because the camera's clock was reset, can be skipped, or edited
+anyway with a warning in the output. Times of zero are always skipped.<br>
+Implausible if before the year <input type="text" name="minyear" size="5" value="`+strconv.Itoa(defaultMinYear)+`"> (0 for no limit)<br>
+<input type="checkbox" name="checkreset" value="1" checked> Implausible if on 1970-01-01, 1980-01-01 or 2000-01-01<br>
+<input type="checkbox" name="checkfuture" value="1" checked> Implausible if in the future<br>
+<input type="checkbox" name="checkupload" value="1" checked> Implausible if after the upload time<br>
+<input type="radio" name="implausible" value="skip" checked> Skip files with implausible times<br>
+<input type="radio" name="implausible" value="flag"> Edit them, with a warning</p>
+<p>To limit the damage from a wrong parameter, the job pauses after a number of failed files, or a number
+of edits that change the date by more than a number of hours, until it's resumed. Zero means no limit.<br>
+Pause after <input type="text" name="maxfailures" size="5" value="`+strconv.Itoa(defaultMaxFailures)+`"> failures,
+or after <input type="text" name="maxshifted" size="5" value="`+strconv.Itoa(defaultMaxShifted)+`"> edits
+that change the date by more than <input type="text" name="maxshift" size="5" value="`+strconv.Itoa(int(defaultMaxShift/time.Hour))+`"> hours</p>
+<p>File titles can be filtered with regular expressions, such as <code>^File:IMG_\d+\.JPG$</code>. Titles are
+matched with either spaces or underscores.</p>
+<p>Only titles matching <input type="text" name="includetitle" size="50"><br>
+Except titles matching <input type="text" name="excludetitle" size="50"></p>
+<p>Files to exclude, one file name or Commons URL per line.<br>
+<textarea name="exclude" rows="4" cols="60"></textarea></p>
+<p>After pressing Submit, it may take some time before output appears. `+describeRates()+` Edits
+can be examined in real-time at your contributions page at Commons. If you need to stop the tool, press the
 browser stop button, close the page, or revoke OAuth access at
 `)
 	writeLink(w, oauthManageURL, "Special:OAuthManageMyGrants")
@@ -237,7 +339,8 @@ func getImageInfo(first, last string, client *mwclient.Client, w http.ResponseWr
 	return imageInfo1, imageInfo2, nil
 }
 
-const batchSize = 100
+// Page content is limited to 50 pages per query for normal users.
+const batchSize = 50
 
 // for use when we only care about ASCII characters, such as tag
 // names, and don't want the length of a UTF8 string to change, as
@@ -309,6 +412,17 @@ func findField(text, field string) (int, int) {
 	}
 }
 
+// Return blanked[start:end] with the original case from text.
+func originalCase(text, blanked string, start, end int) string {
+	value := []byte(blanked[start:end])
+	for i := range value {
+		if value[i] != ' ' {
+			value[i] = text[start+i]
+		}
+	}
+	return string(value)
+}
+
 // Find the Author and Date fields in page text.
 func findPositions(text string) (int, int, int, int) {
 	text = blankNonParsedSections(text)
@@ -317,49 +431,406 @@ func findPositions(text string) (int, int, int, int) {
 	return p1, p2, p3, p4
 }
 
-func edit(title string, newDate time.Time, lastEdit *time.Time, authorFilter string, client *mwclient.Client) error {
-	// Don't attempt to edit more than once per 5 seconds, per Commons bot policy
-	dur := time.Since(*lastEdit)
-	if dur.Seconds() < 5 {
-		time.Sleep(time.Duration(5)*time.Second - dur)
+// The format of DateTimeOriginal in Exif.
+const exifFormat = "2006:01:02 15:04:05"
+
+// Date formats that may be found in a date field that was copied from
+// Exif without adjustment.
+var exifFormats = []string{
+	exifFormat,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+}
+
+var exifTemplateRegexp = regexp.MustCompile(`^\{\{\s*[Aa]ccording to [Ee][Xx][Ii][Ff](?: data)?\s*(\||\}\})`)
+var dtzTemplateRegexp = regexp.MustCompile(`^\{\{\s*DTZ\s*\|`)
+var dtzValueRegexp = regexp.MustCompile(`^\{\{\s*DTZ\s*\|\s*([^|}]*?)\s*(\||\}\})`)
+
+// The format written by this tool, followed by other ISO 8601
+// variations that may be found in {{DTZ}} values.
+const dtzFormat = "2006-01-02T15:04:05-07"
+
+var dtzFormats = []string{
+	dtzFormat,
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05-07",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05-0700",
+	"2006-01-02T15:04-07",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04-0700",
+}
+
+// Parse the time in a {{DTZ}} template, which must be at the start of
+// value. ok is false if there's no template or its time can't be parsed.
+func parseDTZ(value string) (t time.Time, ok bool) {
+	match := dtzValueRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return t, false
+	}
+	for _, format := range dtzFormats {
+		t, err := time.Parse(format, match[1])
+		if err == nil {
+			return t, true
+		}
 	}
-	// There's a small chance that saving a page may fail due to
-	// an edit conflict or other transient error. Try up to 3
-	// times before giving up.
-	var saveError error
-	for i := 0; i < 3; i++ {
-		text, timestamp, err := client.GetPageByName(title)
+	return t, false
+}
+
+func formatOffset(t time.Time) string {
+	return t.Format("-07:00")
+}
+
+func sameOffset(t1, t2 time.Time) bool {
+	_, offset1 := t1.Zone()
+	_, offset2 := t2.Zone()
+	return offset1 == offset2
+}
+
+// Describe the difference between the time in an existing {{DTZ}}
+// template and its replacement.
+func describeChange(oldTime, newTime time.Time) string {
+	wallFormat := "2006-01-02 15:04:05"
+	oldWall := oldTime.Format(wallFormat)
+	newWall := newTime.Format(wallFormat)
+	var change string
+	switch {
+	case sameOffset(oldTime, newTime) && oldWall == newWall:
+		return "existing {{DTZ}} value normalized"
+	case oldWall == newWall:
+		change = "offset only changed from " + formatOffset(oldTime) + " to " + formatOffset(newTime)
+	case sameOffset(oldTime, newTime):
+		change = "wall time only changed from " + oldWall + " to " + newWall
+	default:
+		change = "offset and wall time changed from " + oldWall + formatOffset(oldTime) + " to " + newWall + formatOffset(newTime)
+	}
+	if oldTime.Equal(newTime) {
+		change += ", same instant"
+	} else {
+		change += ", instant moved by " + newTime.Sub(oldTime).String()
+	}
+	return change
+}
+
+// Report whether a date field value can be replaced without losing a
+// manual correction, i.e., if it's empty, is the raw Exif time, or is
+// a template that was generated from Exif.
+func dateReplaceable(value, origTime string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" || exifTemplateRegexp.MatchString(value) || dtzTemplateRegexp.MatchString(value) {
+		return true
+	}
+	exifTime, err := time.Parse(exifFormat, origTime)
+	if err != nil {
+		return false
+	}
+	for _, format := range exifFormats {
+		valueTime, err := time.Parse(format, value)
 		if err != nil {
-			return err
+			continue
+		}
+		if valueTime.Equal(exifTime) || (!strings.Contains(format, ":05") && valueTime.Equal(exifTime.Truncate(time.Minute))) {
+			return true
+		}
+	}
+	return false
+}
+
+var dateTemplateRegexp = regexp.MustCompile(`^\{\{\s*[Dd]ate\s*\|([^}]*)\}\}$`)
+var takenOnRegexp = regexp.MustCompile(`^\{\{\s*[Tt]aken on\s*\|\s*([^|}]*?)\s*(\||\}\})`)
+
+// Parse a date written by hand in a date field, returning it in Exif
+// format.
+func parseWikitextDate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if match := takenOnRegexp.FindStringSubmatch(value); match != nil {
+		value = match[1]
+	} else if match := dateTemplateRegexp.FindStringSubmatch(value); match != nil {
+		fields := strings.Split(match[1], "|")
+		if len(fields) < 5 {
+			return "", errors.New("no time of day in {{Date}}.")
 		}
-		authorStart, authorEnd, dateStart, dateEnd := findPositions(text)
-		if authorFilter != "" {
-			if authorStart == -1 || strings.Index(strings.ToLower(text[authorStart:authorEnd]), authorFilter) == -1 {
-				return errors.New("author didn't match.")
+		nums := make([]int, 6)
+		for i := 0; i < len(fields) && i < len(nums); i++ {
+			num, err := strconv.Atoi(strings.TrimSpace(fields[i]))
+			if err != nil {
+				return "", errors.New("non-numeric field in {{Date}}.")
 			}
+			nums[i] = num
 		}
-		dateStr := fmt.Sprintf("{{DTZ|%s}}", newDate.Format("2006-01-02T15:04:05-07"))
-		newText := text[:dateStart] + dateStr + text[dateEnd:]
-		if newText == text {
-			return errors.New("no change needed.")
+		t := time.Date(nums[0], time.Month(nums[1]), nums[2], nums[3], nums[4], nums[5], 0, time.UTC)
+		return t.Format(exifFormat), nil
+	}
+	for _, format := range exifFormats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t.Format(exifFormat), nil
 		}
-		editcfg := map[string]string{
+	}
+	return "", errors.New("unparseable date " + strconv.Quote(value) + ".")
+}
+
+// Options that are set in the form and apply to every file in a range.
+type options struct {
+	user                  string        // The user making the edits.
+	editInterval          time.Duration // Between edits, by the user's rate policy.
+	markBot               bool          // Mark edits as bot edits.
+	summary               string        // Template for edit summaries.
+	minor                 bool          // Mark wikitext edits as minor.
+	jobID                 int
+	jobStarted            time.Time
+	breaker               breakerLimits
+	othersAllowed         bool   // The user may edit other users' uploads.
+	othersUpload          string // The uploader, if it's not the user.
+	plausibility          plausibilityChecks
+	cameraZone, localZone *time.Location
+	author                *matcher // Filter on the author field, or nil.
+	authorLinks           bool     // Match author link targets instead of wikitext.
+	exifFilters           []exifFilter
+	overwrite             bool
+	offsetOnly            bool
+	fromWikitext          bool // Take dates from the date field instead of Exif.
+	setInception          bool // Also set P571 in structured data.
+	inceptionOnly         bool // Check P571 without editing wikitext.
+	reportOnly            bool // Report P571 disagreements without fixing.
+	// Only process files taken in this window, as wall times in the
+	// camera timezone. Zero if not limited.
+	captureStart, captureEnd time.Time
+	exclude                  map[string]bool // Normalized titles of files to skip.
+	includeTitle             *regexp.Regexp  // If set, only process matching titles.
+	excludeTitle             *regexp.Regexp  // If set, skip matching titles.
+}
+
+type editResult struct {
+	origTime, newTime time.Time
+	change            string // Description of a change to an existing {{DTZ}}.
+	// How far the edit moved the date in the page, or if the old date
+	// is unknown, the offset applied to the camera's time.
+	shift time.Duration
+}
+
+// Check a title against the title filters. Titles with spaces and with
+// underscores are both tried, since filenames are often written with
+// underscores.
+func titleMatches(title string, opts *options) bool {
+	matches := func(re *regexp.Regexp) bool {
+		return re.MatchString(title) || re.MatchString(strings.ReplaceAll(title, " ", "_"))
+	}
+	if opts.includeTitle != nil && !matches(opts.includeTitle) {
+		return false
+	}
+	return opts.excludeTitle == nil || !matches(opts.excludeTitle)
+}
+
+var authorLinkRegexp = regexp.MustCompile(`\[\[\s*:?([^|\]]+)|\{\{\s*([Uu]ser:[^|}]+)`)
+
+// Find the targets of links, and User: templates, in wikitext.
+func linkTargets(text string) []string {
+	var targets []string
+	for _, match := range authorLinkRegexp.FindAllStringSubmatch(text, -1) {
+		target := match[1]
+		if target == "" {
+			target = match[2]
+		}
+		targets = append(targets, strings.ReplaceAll(strings.TrimSpace(target), "_", " "))
+	}
+	return targets
+}
+
+func authorMatches(text string, authorStart, authorEnd int, opts *options) bool {
+	if opts.author == nil {
+		return true
+	}
+	var author string
+	if authorStart != -1 {
+		author = text[authorStart:authorEnd]
+	}
+	if opts.authorLinks {
+		return opts.author.matchesAny(linkTargets(author))
+	}
+	return opts.author.matches(author)
+}
+
+// The wikitext of a page and the timestamp of the revision.
+type revision struct {
+	content, timestamp string
+}
+
+// Get the current revision of a page, unless it's already known.
+func getRevision(title string, known *revision, client *mwclient.Client) (*revision, error) {
+	if known != nil {
+		return known, nil
+	}
+	content, timestamp, err := client.GetPageByName(title)
+	if err != nil {
+		return nil, err
+	}
+	return &revision{content, timestamp}, nil
+}
+
+// Returned by planEdit when the date is already correct.
+var errNoChange = errors.New("no change needed.")
+
+// A new version of a page's wikitext, ready to be saved.
+type editPlan struct {
+	newText, timestamp, summary string
+	result                      editResult
+}
+
+// Work out the edit that sets the date of a file to origTime, which is
+// in Exif format, converted from the camera to the local timezone. If
+// taking dates from wikitext, origTime is ignored and the existing date
+// is converted instead. If the date is already correct, returns the
+// plan with errNoChange.
+func planEdit(origTime string, rev *revision, opts *options) (editPlan, error) {
+	noplan := editPlan{}
+	var plan editPlan
+	text := rev.content
+	authorStart, authorEnd, dateStart, dateEnd := findPositions(text)
+	if !authorMatches(text, authorStart, authorEnd, opts) {
+		return noplan, skipError("author didn't match.")
+	}
+	if dateStart == -1 {
+		return noplan, skipError("date field not found.")
+	}
+	oldValue := originalCase(text, blankNonParsedSections(text), dateStart, dateEnd)
+	oldDate, isDTZ := parseDTZ(oldValue)
+	var err error
+	if opts.fromWikitext {
+		if isDTZ {
+			return noplan, skipError("date is already {{DTZ}}.")
+		}
+		origTime, err = parseWikitextDate(oldValue)
+		if err != nil {
+			return noplan, err
+		}
+	} else if !opts.overwrite && !dateReplaceable(oldValue, origTime) {
+		return noplan, skipError("date appears curated.")
+	}
+	plan.result.origTime, err = time.ParseInLocation(exifFormat, origTime, opts.cameraZone)
+	if err != nil {
+		return noplan, fmt.Errorf("failed to parse the timestamp: %v", err)
+	}
+	newDate := plan.result.origTime.In(opts.localZone)
+	plan.result.newTime = newDate
+	if opts.offsetOnly && (!isDTZ || sameOffset(oldDate, newDate)) {
+		return noplan, skipError("no {{DTZ}} date with a different offset.")
+	}
+	dateStr := fmt.Sprintf("{{DTZ|%s}}", newDate.Format(dtzFormat))
+	plan.newText = text[:dateStart] + dateStr + text[dateEnd:]
+	if plan.newText == text {
+		return plan, errNoChange
+	}
+	// Dates without a timezone are compared by wall time. If the old
+	// date is empty or can't be parsed, e.g., {{According to Exif
+	// data}}, the camera's time is used instead.
+	newWall, _ := time.Parse(exifFormat, newDate.Format(exifFormat))
+	oldWall, err := parseWikitextDate(oldValue)
+	if err != nil {
+		oldWall = origTime
+	}
+	oldTime, _ := time.Parse(exifFormat, oldWall)
+	plan.result.shift = newWall.Sub(oldTime)
+	if isDTZ {
+		plan.result.change = describeChange(oldDate, newDate)
+		plan.result.shift = newDate.Sub(oldDate)
+	}
+	plan.timestamp = rev.timestamp
+	plan.summary = editSummary("Set date from Exif with time zone", newDate, opts)
+	if opts.fromWikitext {
+		plan.summary = editSummary("Set time zone of existing date", newDate, opts)
+	}
+	return plan, nil
+}
+
+// Add the parameters that apply to every edit made by the tool, to
+// the wikitext or structured data.
+func addEditParams(p params.Values, opts *options) {
+	if opts.markBot {
+		p["bot"] = "1"
+	}
+	// Structured data edits can't be marked as minor.
+	if opts.minor && p["action"] == "edit" {
+		p["minor"] = "1"
+	}
+	if changeTag != "" {
+		p["tags"] = changeTag
+	}
+}
+
+// The edit summary template used if none is given.
+const defaultSummary = "$action: $camera to $location, offset $offset ($job)"
+
+// The offset applied to the camera's wall time at the instant t, i.e.,
+// the location's UTC offset less the camera's.
+func appliedOffset(t time.Time, opts *options) string {
+	_, camera := t.In(opts.cameraZone).Zone()
+	_, local := t.In(opts.localZone).Zone()
+	diff := local - camera
+	sign := "+"
+	if diff < 0 {
+		sign = "-"
+		diff = -diff
+	}
+	return fmt.Sprintf("%s%02d:%02d", sign, diff/3600, diff%3600/60)
+}
+
+// A label for the job in edit summaries, linking to the tool. Job
+// numbers start again when the tool restarts, so the start time is
+// included to tell jobs apart.
+func jobLabel(opts *options) string {
+	return fmt.Sprintf("[[toolforge:dtz|dtz]] job %d, %s", opts.jobID, opts.jobStarted.UTC().Format("2006-01-02 15:04"))
+}
+
+// Fill in the summary template for an edit that sets a date to t.
+func editSummary(action string, t time.Time, opts *options) string {
+	source := "Exif"
+	if opts.fromWikitext {
+		source = "date field"
+	}
+	summary := strings.NewReplacer(
+		"$action", action,
+		"$camera", opts.cameraZone.String(),
+		"$location", opts.localZone.String(),
+		"$offset", appliedOffset(t, opts),
+		"$source", source,
+		"$job", jobLabel(opts),
+	).Replace(opts.summary)
+	if opts.othersUpload != "" {
+		summary += "; upload by [[User:" + opts.othersUpload + "|" + opts.othersUpload + "]]"
+	}
+	return summary
+}
+
+// Save a planned edit. If there's an edit conflict, the page is
+// fetched and the edit planned again.
+func saveEdit(title, origTime string, plan editPlan, limiter *rateLimiter, opts *options, client *mwclient.Client) (editResult, error) {
+	save := func() error {
+		editcfg := params.Values{
 			"action":        "edit",
 			"title":         title,
-			"text":          newText,
-			"summary":       "Set date from Exif with time zone",
-			"basetimestamp": timestamp,
+			"text":          plan.newText,
+			"summary":       plan.summary,
+			"basetimestamp": plan.timestamp,
 		}
-		saveError = client.Edit(editcfg)
-		if saveError == nil {
-			break
+		addEditParams(editcfg, opts)
+		return postEdit(editcfg, client)
+	}
+	replan := func() error {
+		rev, err := getRevision(title, nil, client)
+		if err != nil {
+			return err
 		}
+		plan, err = planEdit(origTime, rev, opts)
+		return err
 	}
-	if saveError != nil {
-		return fmt.Errorf("failed to save: %v", saveError)
+	if err := saveWithRetries(save, replan, limiter, client); err != nil {
+		return plan.result, err
 	}
-	*lastEdit = time.Now()
-	return nil
+	return plan.result, nil
 }
 
 func printTitle(w http.ResponseWriter, title string) {
@@ -367,116 +838,325 @@ func printTitle(w http.ResponseWriter, title string) {
 	writeString(w, " &mdash; ")
 }
 
-func processRange(uploadTime1, uploadTime2, user string, cameraZone, localZone *time.Location, authorFilter, modelFilter string, client *mwclient.Client, w http.ResponseWriter) {
-	writeString(w, "<p>To stop this tool, press the browser stop button, close the page, or revoke OAuth access at ")
-	writeLink(w, oauthManageURL, "Special:OAuthManageMyGrants")
-	writeString(w, ".</p><p>\n")
-	params := params.Values{
-		"generator": "allimages",
-		"gaiuser":   user,
-		"gaisort":   "timestamp",
-		"gaidir":    "ascending",
-		"gailimit":  strconv.Itoa(batchSize),
-		"prop":      "imageinfo",
-		"iiprop":    "commonmetadata",
-		"gaistart":  uploadTime1,
-		"gaiend":    uploadTime2,
-	}
-	flusher, haveFlush := w.(http.Flusher)
-	if !haveFlush {
-		writeString(w, "Expected a flush method.")
-		return
-	}
-	var lastEdit time.Time
-	query := client.NewQuery(params)
-queryLoop:
+// Outcomes of processing a file, counted for the summary at the end
+// of a job.
+type outcome string
+
+const (
+	outcomeEdited      outcome = "edited"
+	outcomeUnchanged   outcome = "unchanged"
+	outcomeReported    outcome = "reported"
+	outcomeExcluded    outcome = "excluded"
+	outcomeFiltered    outcome = "title filtered"
+	outcomeSkipped     outcome = "skipped"
+	outcomeImplausible outcome = "implausible"
+	outcomeFailed      outcome = "failed"
+
+	// Failures to save, by the error from the API.
+	outcomeConflict    outcome = "edit conflict"
+	outcomeMaxlag      outcome = "maxlag"
+	outcomeRateLimited outcome = "rate limited"
+	outcomeBadToken    outcome = "bad token"
+	outcomeReadOnly    outcome = "read only"
+	outcomeProtected   outcome = "protected"
+	outcomeAbuseFilter outcome = "abuse filter"
+)
+
+// The order in which outcomes are listed in the summary.
+var outcomes = []outcome{outcomeEdited, outcomeUnchanged, outcomeReported, outcomeExcluded, outcomeFiltered, outcomeSkipped, outcomeImplausible, outcomeFailed,
+	outcomeConflict, outcomeMaxlag, outcomeRateLimited, outcomeBadToken, outcomeReadOnly, outcomeProtected, outcomeAbuseFilter}
+
+// An error for a file that was deliberately not edited, e.g., because
+// it didn't match a filter.
+type skipError string
+
+func (e skipError) Error() string {
+	return string(e)
+}
+
+func errorOutcome(err error) outcome {
+	if err == errNoChange {
+		return outcomeUnchanged
+	}
+	if _, ok := err.(skipError); ok {
+		return outcomeSkipped
+	}
+	if e, ok := err.(saveError); ok {
+		return e.o
+	}
+	return outcomeFailed
+}
+
+// Add the parameters for the properties needed by prepare: Exif data
+// and the current wikitext.
+func addInfoParams(params params.Values) {
+	params["prop"] = "imageinfo|revisions"
+	params["iiprop"] = "commonmetadata|user|timestamp"
+	params["rvprop"] = "content|timestamp"
+	params["rvslots"] = "main"
+}
+
+// Get the current revision from a page object, or nil if it wasn't
+// included, e.g., because the response was too large.
+func pageRevision(obj *jason.Object) *revision {
+	revisions, err := obj.GetObjectArray("revisions")
+	if err != nil || len(revisions) == 0 {
+		return nil
+	}
+	content, err := revisions[0].GetString("slots", "main", "content")
+	if err != nil {
+		return nil
+	}
+	timestamp, err := revisions[0].GetString("timestamp")
+	if err != nil {
+		return nil
+	}
+	return &revision{content, timestamp}
+}
+
+// Process the files returned by a query generator. Returns false if
+// the job was cancelled.
+func (j *job) processQuery(params params.Values, opts *options) bool {
+	addInfoParams(params)
+	query := j.client.NewQuery(params)
 	for query.Next() {
 		json := query.Resp()
 		pages, err := json.GetObjectArray("query", "pages")
 		if err != nil {
-			writeString(w, "Skipped a batch with missing pages array.<br>\n")
+			if !j.note("Skipped a batch with missing pages array.<br>\n") {
+				return false
+			}
 			continue
 		}
 		if len(pages) == 0 {
 			break
 		}
-		for i, _ := range pages {
-			time.Sleep(time.Duration(1) * time.Second)
-			flusher.Flush()
-			obj, err := pages[i].Object()
-			if err != nil {
-				writeString(w, "Skipped an item with missing pages object.<br>\n")
-				continue
+		for i := range pages {
+			if !j.processPage(pages[i], opts) {
+				return false
 			}
-			title, err := obj.GetString("title")
-			if err != nil {
-				printTitle(w, title)
-				writeString(w, "Skipped an item with no title.<br>\n")
-				continue
+		}
+	}
+	if query.Err() != nil {
+		return j.note("Query returned an error: " + html.EscapeString(query.Err().Error()) + "<br>")
+	}
+	return true
+}
+
+// Prepare a file for editing, from a page object from a query with
+// imageinfo and revisions. This runs in the read-ahead stage, so it
+// doesn't edit or write output.
+func prepare(title string, obj *jason.Object, opts *options, client *mwclient.Client) *prepared {
+	p := &prepared{title: title, opts: opts}
+	finished := func(o outcome, message string) *prepared {
+		p.o = o
+		p.message = message
+		return p
+	}
+	infoArray, err := obj.GetObjectArray("imageinfo")
+	if err != nil {
+		return finished(outcomeFailed, "missing imageinfo array.")
+	}
+	pageID, err := obj.GetInt64("pageid")
+	if err != nil {
+		return finished(outcomeFailed, "missing page ID.")
+	}
+	p.pageID = strconv.FormatInt(pageID, 10)
+	if uploader, _ := infoArray[0].GetString("user"); uploader != opts.user {
+		if !opts.othersAllowed {
+			return finished(outcomeSkipped, "uploaded by "+uploader+", not by you.")
+		}
+		fileOpts := *opts
+		fileOpts.othersUpload = uploader
+		opts = &fileOpts
+		p.opts = opts
+	}
+	metadata, err := infoArray[0].GetObjectArray("commonmetadata")
+	if err != nil && !opts.fromWikitext {
+		return finished(outcomeSkipped, "no commonmetadata.")
+	}
+	values := make(map[string]string)
+	for i := 0; i < len(metadata); i++ {
+		name, err := metadata[i].GetString("name")
+		if err != nil {
+			continue
+		}
+		if value, err := metadata[i].GetString("value"); err == nil {
+			values[name] = value
+		} else if number, err := metadata[i].GetNumber("value"); err == nil {
+			// Serial numbers may be numeric.
+			values[name] = number.String()
+		}
+	}
+	p.origTime = values["DateTimeOriginal"]
+	if p.origTime == "" && !opts.fromWikitext {
+		return finished(outcomeSkipped, "time not found in metadata.")
+	}
+	if label := failedExifFilter(values, opts.exifFilters); label != "" {
+		return finished(outcomeSkipped, label+" didn't match.")
+	}
+	if !opts.fromWikitext && !(opts.captureStart.IsZero() && opts.captureEnd.IsZero()) {
+		taken, err := time.Parse(exifFormat, p.origTime)
+		if err != nil {
+			return finished(outcomeFailed, "failed to parse the timestamp: "+err.Error())
+		}
+		if (!opts.captureStart.IsZero() && taken.Before(opts.captureStart)) || (!opts.captureEnd.IsZero() && taken.After(opts.captureEnd)) {
+			return finished(outcomeSkipped, "taken outside the time window.")
+		}
+	}
+	if !opts.fromWikitext {
+		var uploaded time.Time
+		if timestamp, err := infoArray[0].GetString("timestamp"); err == nil {
+			uploaded, _ = time.Parse(time.RFC3339, timestamp)
+		}
+		if reason := implausible(p.origTime, uploaded, opts); reason != "" {
+			if !opts.plausibility.flagOnly || zeroTime(p.origTime) {
+				return finished(outcomeImplausible, "implausible date: "+reason+".")
 			}
-			infoArray, err := obj.GetObjectArray("imageinfo")
+			p.implausible = reason
+		}
+	}
+	rev := pageRevision(obj)
+	if opts.inceptionOnly {
+		// The wikitext is only needed for the author filter.
+		if opts.author != nil {
+			rev, err = getRevision(title, rev, client)
 			if err != nil {
-				printTitle(w, title)
-				writeString(w, "missing imageinfo array.<br>\n")
-				continue
+				return finished(outcomeFailed, err.Error())
 			}
-			printTitle(w, title)
-			metadata, err := infoArray[0].GetObjectArray("commonmetadata")
-			if err != nil {
-				writeString(w, "no commonmetadata.<br>\n")
-				continue
+			authorStart, authorEnd, _, _ := findPositions(rev.content)
+			if !authorMatches(rev.content, authorStart, authorEnd, opts) {
+				return finished(outcomeSkipped, "author didn't match.")
 			}
-			var origTime string
-			var model string
-			for i := 0; i < len(metadata); i++ {
-				name, err := metadata[i].GetString("name")
-				if err != nil {
-					continue
-				}
-				if name == "DateTimeOriginal" {
-					origTime, _ = metadata[i].GetString("value")
-				} else if name == "Model" {
-					model, _ = metadata[i].GetString("value")
-					if err != nil {
-						continue
-					}
-				}
+		}
+		origTimeParsed, err := time.ParseInLocation(exifFormat, p.origTime, opts.cameraZone)
+		if err != nil {
+			return finished(outcomeFailed, "failed to parse the timestamp: "+err.Error())
+		}
+		p.plan.result.newTime = origTimeParsed.In(opts.localZone)
+		return p
+	}
+	rev, err = getRevision(title, rev, client)
+	if err != nil {
+		return finished(outcomeFailed, err.Error())
+	}
+	p.plan, p.planErr = planEdit(p.origTime, rev, opts)
+	if p.planErr != nil && !(p.planErr == errNoChange && opts.setInception) {
+		return finished(errorOutcome(p.planErr), p.planErr.Error())
+	}
+	return p
+}
+
+// Make the edits for a prepared file, and write the outcome. This runs
+// in the editor stage. Returns false if the connection to the browser
+// was lost or the job was cancelled.
+func (j *job) commit(p *prepared) bool {
+	if p.note != "" {
+		return writeString(j.w, p.note) == nil
+	}
+	printTitle(j.w, p.title)
+	if p.implausible != "" {
+		writeString(j.w, html.EscapeString("implausible date: "+p.implausible+"; "))
+	}
+	if p.o != "" {
+		return j.report(p.o, p.message)
+	}
+	opts := p.opts
+	if opts.inceptionOnly {
+		message, o, err := reconcileInception(p.pageID, p.plan.result.newTime, !opts.reportOnly, editSummary("Set inception from Exif with time zone", p.plan.result.newTime, opts), opts, &j.limiter, j.client)
+		if err != nil {
+			return j.ctx.Err() == nil && j.report(errorOutcome(err), err.Error())
+		}
+		return j.report(o, message)
+	}
+	var message string
+	o := outcomeEdited
+	result := p.plan.result
+	if p.planErr == errNoChange {
+		message = p.planErr.Error()
+		o = outcomeUnchanged
+	} else {
+		var err error
+		result, err = saveEdit(p.title, p.origTime, p.plan, &j.limiter, opts, j.client)
+		if err != nil && !(err == errNoChange && opts.setInception) {
+			return j.ctx.Err() == nil && j.report(errorOutcome(err), err.Error())
+		}
+		if err == errNoChange {
+			message = err.Error()
+			o = outcomeUnchanged
+		} else {
+			j.shifted(result)
+			message = "date-time " + result.origTime.Format(exifFormat) + " converted to " + result.newTime.Format(exifFormat)
+			if result.change != "" {
+				message += "; " + result.change
+			}
+		}
+	}
+	if opts.setInception {
+		summary := editSummary("Set inception from Exif with time zone", result.newTime, opts)
+		if opts.fromWikitext {
+			summary = editSummary("Set inception from date with time zone", result.newTime, opts)
+		}
+		inception, inceptionOutcome, err := setInception(p.pageID, result.newTime, summary, opts, &j.limiter, j.client)
+		if err != nil {
+			if j.ctx.Err() != nil {
+				return false
 			}
-			if origTime == "" {
-				writeString(w, "time not found in metadata.<br>\n")
-				continue
+			inception = err.Error()
+			o = errorOutcome(err)
+		} else if inceptionOutcome == outcomeEdited {
+			o = outcomeEdited
+		}
+		message += "; " + inception
+	}
+	return j.report(o, message)
+}
+
+// A range of uploads by a user, which may be open at either end. The
+// zones override those in the job's options, if set.
+type uploadRange struct {
+	start, end, user      string
+	cameraZone, localZone *time.Location
+}
+
+func processRanges(ctx context.Context, ranges []uploadRange, opts *options, client *mwclient.Client, w http.ResponseWriter) {
+	j := startJob(ctx, opts, client, w)
+	if j == nil {
+		return
+	}
+	j.run(func() {
+		for _, r := range ranges {
+			rangeOpts := *opts
+			if r.cameraZone != nil {
+				rangeOpts.cameraZone = r.cameraZone
+			}
+			if r.localZone != nil {
+				rangeOpts.localZone = r.localZone
 			}
-			if modelFilter != "" {
-				if model == "" || strings.Index(strings.ToLower(model), modelFilter) == -1 {
-					writeString(w, "camera model didn't match.<br>\n")
-					continue
+			if len(ranges) > 1 {
+				if !j.note("Uploads by " + html.EscapeString(r.user) + " from " + r.start + " to " + r.end + ":<br>\n") {
+					return
 				}
 			}
-			timeStampFormat := "2006:01:02 15:04:05"
-			origTimeParsed, err := time.ParseInLocation(timeStampFormat, origTime, cameraZone)
-			if err != nil {
-				writeString(w, "failed to parse the timestamp: ")
-				writeString(w, err.Error())
-				writeString(w, "<br>\n")
-				continue
+			params := params.Values{
+				"generator": "allimages",
+				"gaiuser":   r.user,
+				"gaisort":   "timestamp",
+				"gaidir":    "ascending",
+				"gailimit":  strconv.Itoa(batchSize),
 			}
-			origTimeConverted := origTimeParsed.In(localZone)
-			err = edit(title, origTimeConverted, &lastEdit, authorFilter, client)
-			if err != nil {
-				writeString(w, err.Error()+"<br>\n")
-				continue
+			if r.start != "" {
+				params["gaistart"] = r.start
 			}
-			err = writeString(w, "date-time "+origTimeParsed.Format(timeStampFormat)+" converted to "+origTimeConverted.Format(timeStampFormat)+"<br>\n")
-			if err != nil {
-				// Presumably lost the connection to the browser.
-				break queryLoop
+			if r.end != "" {
+				params["gaiend"] = r.end
+			}
+			if !j.processQuery(params, &rangeOpts) {
+				return
 			}
 		}
-	}
-	if query.Err() != nil {
-		writeString(w, "Query returned an error: "+query.Err().Error()+"<br>")
-	}
-	writeString(w, "</body></html>")
+	})
+	j.finish()
 }
 
 func dateParam(param string) (*time.Location, error) {
@@ -498,7 +1178,14 @@ func dateParam(param string) (*time.Location, error) {
 func fileParam(param string) (string, error) {
 	filePrefix := "File:"
 	badChars := "/|"
-	param = strings.TrimPrefix(param, commonsWiki)
+	if strings.HasPrefix(param, commonsWiki) {
+		// Titles in URLs are escaped.
+		unescaped, err := url.PathUnescape(strings.TrimPrefix(param, commonsWiki))
+		if err != nil {
+			return "", err
+		}
+		param = strings.ReplaceAll(unescaped, "_", " ")
+	}
 	if strings.ContainsAny(param, badChars) {
 		return "", errors.New("Filenames may not contain the characters " + badChars)
 	}
@@ -511,6 +1198,80 @@ func fileParam(param string) (string, error) {
 	return param, nil
 }
 
+// Normalize a file title as returned by the API.
+func normalizeTitle(title string) string {
+	title = strings.ReplaceAll(title, "_", " ")
+	colon := strings.Index(title, ":")
+	name := []rune(title[colon+1:])
+	if len(name) > 0 {
+		name[0] = unicode.ToUpper(name[0])
+	}
+	return title[:colon+1] + string(name)
+}
+
+// A range of files as specified in the form, with optional timezones
+// for the range.
+type rangeSpec struct {
+	first, last           string
+	cameraZone, localZone *time.Location
+}
+
+// Parse additional ranges, one per line, in the format
+// "first | last | camera zone | location zone", where the zones are
+// optional.
+func rangesParam(param string) ([]rangeSpec, error) {
+	var specs []rangeSpec
+	for i, line := range strings.Split(param, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("Line %d: expected first and last files, and optionally two timezones, separated by |", i+1)
+		}
+		var spec rangeSpec
+		var err error
+		if spec.first, err = fileParam(strings.TrimSpace(fields[0])); err == nil {
+			spec.last, err = fileParam(strings.TrimSpace(fields[1]))
+		}
+		if err == nil && len(fields) > 2 {
+			spec.cameraZone, err = dateParam(strings.TrimSpace(fields[2]))
+		}
+		if err == nil && len(fields) > 3 {
+			spec.localZone, err = dateParam(strings.TrimSpace(fields[3]))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+		// As in the main form, a single timezone applies to both.
+		if spec.cameraZone == nil {
+			spec.cameraZone = spec.localZone
+		}
+		if spec.localZone == nil {
+			spec.localZone = spec.cameraZone
+		}
+		if spec.first == "" || spec.last == "" {
+			return nil, fmt.Errorf("Line %d: missing file name", i+1)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Compile a regular expression from the form. Returns nil if param is
+// empty.
+func regexpParam(param string) (*regexp.Regexp, error) {
+	if param == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(param)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression %s: %v", strconv.Quote(param), err)
+	}
+	return re, nil
+}
+
 func trimmedField(field string, r *http.Request) string {
 	return strings.TrimSpace(r.Form.Get(field))
 }
@@ -552,59 +1313,302 @@ func outputHandler(w http.ResponseWriter, r *http.Request) {
 		preMessage(w, title, "Please supply at least one time zone.")
 		return
 	}
-	first, err := fileParam(trimmedField("first", r))
+	captureStart, err := timeParam(trimmedField("takenfrom", r), false)
 	if err != nil {
 		preError(w, title, err)
 		return
 	}
-	last, err := fileParam(trimmedField("last", r))
+	captureEnd, err := timeParam(trimmedField("takento", r), true)
 	if err != nil {
 		preError(w, title, err)
 		return
 	}
-	if first == "" {
-		first = last
+	mode := trimmedField("select", r)
+	var first, last, category string
+	var depth int
+	var titles []string
+	var rangeSpecs []rangeSpec
+	var wikiHost, page, search string
+	var uploader, startTime, endTime string
+	switch mode {
+	case selectUploads:
+		// Defaults to the logged-in user, once known.
+		uploader = userParam(trimmedField("uploader", r))
+		startTime, err = timestampParam(trimmedField("start", r), false)
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		endTime, err = timestampParam(trimmedField("end", r), true)
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if startTime == "" && !captureStart.IsZero() {
+			// Files can't be uploaded before they were taken.
+			startTime = wallTimeIn(captureStart, cameraZone).UTC().Format(apiTimestampFormat)
+		}
+		if (startTime == "" || endTime == "") && captureStart.IsZero() && captureEnd.IsZero() {
+			preMessage(w, title, "Please supply both a start and end time, or a time window for when the files were taken.")
+			return
+		}
+		if startTime != "" && endTime != "" && startTime > endTime {
+			preMessage(w, title, "The start time must be before the end time.")
+			return
+		}
+	case selectSearch:
+		search = trimmedField("search", r)
+		if search == "" {
+			preMessage(w, title, "Please supply a search query.")
+			return
+		}
+	case selectPage:
+		wikiHost, page, err = pageParam(trimmedField("page", r))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if page == "" {
+			preMessage(w, title, "Please supply a page.")
+			return
+		}
+	case selectList:
+		titles, err = titlesParam(r.Form.Get("titles"))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if len(titles) == 0 {
+			preMessage(w, title, "Please supply at least one file name.")
+			return
+		}
+	case selectCategory:
+		category, err = categoryParam(trimmedField("category", r))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if category == "" {
+			preMessage(w, title, "Please supply a category.")
+			return
+		}
+		depth, err = depthParam(trimmedField("depth", r))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+	default:
+		mode = selectRange
+		first, err = fileParam(trimmedField("first", r))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		last, err = fileParam(trimmedField("last", r))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if first == "" {
+			first = last
+		}
+		if last == "" {
+			last = first
+		}
+		if first != "" {
+			rangeSpecs = append(rangeSpecs, rangeSpec{first: first, last: last})
+		}
+		more, err := rangesParam(r.Form.Get("ranges"))
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		rangeSpecs = append(rangeSpecs, more...)
+		if len(rangeSpecs) == 0 {
+			preMessage(w, title, "Please supply at least one file name.")
+			return
+		}
+	}
+	exclude, err := titlesParam(r.Form.Get("exclude"))
+	if err != nil {
+		preError(w, title, err)
+		return
 	}
-	if first == "" {
-		preMessage(w, title, "Please supply at least one file name.")
+	author, err := matcherParam("author", r)
+	if err != nil {
+		preError(w, title, err)
 		return
 	}
-	if last == "" {
-		last = first
+	exifFilters, err := exifFiltersParam(r)
+	if err != nil {
+		preError(w, title, err)
+		return
 	}
-	authorFilter := strings.ToLower(trimmedField("author", r))
-	modelFilter := strings.ToLower(trimmedField("model", r))
-	client, err := mwclient.New(commonsPrefix+"w/api.php", "dtz; User:Ghouston")
+	includeTitle, err := regexpParam(trimmedField("includetitle", r))
 	if err != nil {
 		preError(w, title, err)
 		return
 	}
-	client.Maxlag.On = true
-	userName, err := authClient(client, accessToken.Value, accessSecret.Value)
+	excludeTitle, err := regexpParam(trimmedField("excludetitle", r))
 	if err != nil {
 		preError(w, title, err)
 		return
 	}
-	imageInfo1, imageInfo2, err := getImageInfo(first, last, client, w)
+	opts := options{
+		cameraZone:    cameraZone,
+		localZone:     localZone,
+		author:        author,
+		authorLinks:   trimmedField("authorlinks", r) != "",
+		exifFilters:   exifFilters,
+		overwrite:     trimmedField("overwrite", r) != "",
+		offsetOnly:    trimmedField("offsetonly", r) != "",
+		fromWikitext:  trimmedField("source", r) == "wikitext",
+		setInception:  trimmedField("inception", r) != "",
+		inceptionOnly: trimmedField("inceptiononly", r) != "",
+		reportOnly:    trimmedField("reportonly", r) != "",
+		summary:       trimmedField("summary", r),
+		minor:         trimmedField("minor", r) != "",
+		captureStart:  captureStart,
+		captureEnd:    captureEnd,
+		exclude:       make(map[string]bool),
+		includeTitle:  includeTitle,
+		excludeTitle:  excludeTitle,
+	}
+	for _, t := range exclude {
+		opts.exclude[normalizeTitle(t)] = true
+	}
+	if opts.summary == "" {
+		opts.summary = defaultSummary
+	}
+	opts.breaker, err = breakerParam(r)
 	if err != nil {
 		preError(w, title, err)
 		return
 	}
-	if imageInfo1.uploadTime > imageInfo2.uploadTime {
-		tmp := imageInfo1
-		imageInfo1 = imageInfo2
-		imageInfo2 = tmp
+	opts.plausibility, err = plausibilityParam(r)
+	if err != nil {
+		preError(w, title, err)
+		return
+	}
+	if opts.fromWikitext && !(captureStart.IsZero() && captureEnd.IsZero()) {
+		preMessage(w, title, "Selecting files by when they were taken requires dates from Exif.")
+		return
+	}
+	if opts.inceptionOnly && opts.fromWikitext {
+		preMessage(w, title, "Only checking inception requires dates from Exif.")
+		return
 	}
-	if imageInfo1.user != imageInfo2.user {
-		preMessage(w, title, "Two files must be uploaded by the same user.")
+	client, err := mwclient.New(commonsPrefix+"w/api.php", "dtz; User:Ghouston")
+	if err != nil {
+		preError(w, title, err)
+		return
+	}
+	client.Maxlag.On = true
+	user, err := authClient(client, accessToken.Value, accessSecret.Value)
+	if err != nil {
+		preError(w, title, err)
+		return
+	}
+	opts.user = user.name
+	opts.editInterval = userInterval(user)
+	opts.markBot = user.hasRight("bot")
+	opts.othersAllowed = user.mayEditOthers()
+	if mode == selectUploads {
+		if uploader == "" {
+			uploader = user.name
+		}
+		uploader, err = checkUploader(uploader, client)
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if uploader != user.name && !opts.othersAllowed {
+			preMessage(w, title, othersMessage(uploader))
+			return
+		}
+		ranges := []uploadRange{{start: startTime, end: endTime, user: uploader}}
+		if !confirmUploads(w, r, title, ranges, client) {
+			return
+		}
+		writeEditingAs(w, title, user.name)
+		processRanges(r.Context(), ranges, &opts, client, w)
+		return
+	}
+	if mode == selectSearch {
+		total, err := searchTotal(search, client)
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if !confirmSearch(w, r, title, search, total) {
+			return
+		}
+		writeEditingAs(w, title, user.name)
+		processSearch(r.Context(), search, total, &opts, client, w)
+		return
+	}
+	if mode == selectPage {
+		titles, err = pageImages(wikiHost, page, client)
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		if len(titles) == 0 {
+			preMessage(w, title, "The page doesn't use any files.")
+			return
+		}
+		mode = selectList
+	}
+	if mode == selectList {
+		writeEditingAs(w, title, user.name)
+		processList(r.Context(), titles, &opts, client, w)
+		return
+	}
+	if mode == selectCategory {
+		categories, err := subcategories(category, depth, client)
+		if err != nil {
+			preError(w, title, err)
+			return
+		}
+		writeEditingAs(w, title, user.name)
+		processCategories(r.Context(), categories, &opts, client, w)
 		return
 	}
+	var ranges []uploadRange
+	for _, spec := range rangeSpecs {
+		imageInfo1, imageInfo2, err := getImageInfo(spec.first, spec.last, client, w)
+		if err != nil {
+			preError(w, title, fmt.Errorf("%s: %v", spec.first, err))
+			return
+		}
+		if imageInfo1.uploadTime > imageInfo2.uploadTime {
+			tmp := imageInfo1
+			imageInfo1 = imageInfo2
+			imageInfo2 = tmp
+		}
+		if imageInfo1.user != imageInfo2.user {
+			preMessage(w, title, "Two files must be uploaded by the same user: "+spec.first+", "+spec.last)
+			return
+		}
+		if imageInfo1.user != user.name && !opts.othersAllowed {
+			preMessage(w, title, othersMessage(imageInfo1.user))
+			return
+		}
+		ranges = append(ranges, uploadRange{imageInfo1.uploadTime, imageInfo2.uploadTime, imageInfo1.user, spec.cameraZone, spec.localZone})
+	}
+	if !confirmUploads(w, r, title, ranges, client) {
+		return
+	}
+	writeEditingAs(w, title, user.name)
+	processRanges(r.Context(), ranges, &opts, client, w)
+}
+
+func writeEditingAs(w http.ResponseWriter, title, userName string) {
 	writeHead(w, title)
 	writeString(w, "<body>\n")
 	writeString(w, "<p>Editing as user ")
-	writeString(w, userName)
+	writeString(w, html.EscapeString(userName))
 	writeString(w, "</p>")
-	processRange(imageInfo1.uploadTime, imageInfo2.uploadTime, imageInfo1.user, cameraZone, localZone, authorFilter, modelFilter, client, w)
 }
 
 func loadPrivateKey() (*rsa.PrivateKey, error) {
@@ -661,22 +1665,26 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, toolRelative, http.StatusSeeOther)
 }
 
-func authClient(client *mwclient.Client, oauthToken, oauthSecret string) (string, error) {
+func authClient(client *mwclient.Client, oauthToken, oauthSecret string) (*userInfo, error) {
 	consumerToken := os.Getenv("ConsumerToken")
 	if consumerToken == "" {
-		return "", errors.New("OAuth consumer token not set in environment.")
+		return nil, errors.New("OAuth consumer token not set in environment.")
 	}
 	consumer := oauth.NewRSAConsumer(consumerToken, privateKey, oauth.ServiceProvider{RequestTokenUrl: oauthRequestURL, AuthorizeTokenUrl: oauthAuthorizeURL, AccessTokenUrl: oauthAccessURL})
 	httpc, err := consumer.MakeHttpClient(&oauth.AccessToken{Token: oauthToken, Secret: oauthSecret})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	userName, err := checkUser(httpc)
+	user, err := checkUser(httpc)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	if httpc.Transport == nil {
+		httpc.Transport = http.DefaultTransport
+	}
+	httpc.Transport = retryAfterTransport{httpc.Transport, editScheduler}
 	client.SetHTTPClient(httpc)
-	return userName, nil
+	return user, nil
 }
 
 func authGetAccess(token, verifier string) (string, string, error) {
@@ -692,60 +1700,117 @@ func authGetAccess(token, verifier string) (string, string, error) {
 	return access.Token, access.Secret, nil
 }
 
-func checkUser(client *http.Client) (string, error) {
+// The OAuth user, as identified by Special:OAuth/identify.
+type userInfo struct {
+	name   string
+	groups []string
+	rights []string
+}
+
+func (u *userInfo) inGroup(group string) bool {
+	for _, g := range u.groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups whose members may edit uploads by other users. May be replaced
+// with the OthersGroups environment variable, e.g., "sysop,filemover".
+var othersGroups = []string{"sysop", "filemover"}
+
+func loadOthersGroups() {
+	if config := os.Getenv("OthersGroups"); config != "" {
+		othersGroups = nil
+		for _, group := range strings.Split(config, ",") {
+			othersGroups = append(othersGroups, strings.TrimSpace(group))
+		}
+	}
+}
+
+func (u *userInfo) mayEditOthers() bool {
+	for _, group := range othersGroups {
+		if u.inGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func othersMessage(uploader string) string {
+	return "The files were uploaded by " + uploader + ". Only members of these groups may edit other users' uploads: " + strings.Join(othersGroups, ", ") + "."
+}
+
+func (u *userInfo) hasRight(right string) bool {
+	for _, r := range u.rights {
+		if r == right {
+			return true
+		}
+	}
+	return false
+}
+
+func checkUser(client *http.Client) (*userInfo, error) {
 	resp, err := client.Get(commonsWiki + "Special:OAuth/identify")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	body, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	consumerSecret := os.Getenv("ConsumerSecret")
 	if consumerSecret == "" {
-		return "", errors.New("OAuth consumer secret not set in environment.")
+		return nil, errors.New("OAuth consumer secret not set in environment.")
 	}
 	token, err := jwt.Parse(string(body), func(token *jwt.Token) (interface{}, error) { return []byte(consumerSecret), nil })
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if !token.Valid {
-		return "", errors.New("Invalid OAuth/identify token.")
+		return nil, errors.New("Invalid OAuth/identify token.")
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return "", errors.New("Claims not a map?")
+		return nil, errors.New("Claims not a map?")
 	}
 	blocked, ok := claims["blocked"].(bool)
 	if !ok {
-		return "", errors.New("Claims.blocked is not bool")
+		return nil, errors.New("Claims.blocked is not bool")
 	}
 	groups, ok := claims["groups"].([]interface{})
 	if !ok {
-		return "", errors.New("Claims.groups is not an array of interfaces")
+		return nil, errors.New("Claims.groups is not an array of interfaces")
 	}
-	autoconfirmed := false
+	user := &userInfo{}
 	for i := range groups {
 		group, ok := groups[i].(string)
 		if !ok {
-			return "", errors.New("Claims.groups[i] is not a string")
+			return nil, errors.New("Claims.groups[i] is not a string")
 		}
-		if group == "autoconfirmed" {
-			autoconfirmed = true
+		user.groups = append(user.groups, group)
+	}
+	rights, _ := claims["rights"].([]interface{})
+	for i := range rights {
+		right, ok := rights[i].(string)
+		if !ok {
+			return nil, errors.New("Claims.rights[i] is not a string")
 		}
+		user.rights = append(user.rights, right)
 	}
-	if !autoconfirmed {
-		return "", errors.New("User is not autoconfirmed.")
+	if !user.inGroup("autoconfirmed") {
+		return nil, errors.New("User is not autoconfirmed.")
 	}
 	if blocked {
-		return "", errors.New("User is blocked.")
+		return nil, errors.New("User is blocked.")
 	}
-	userName, ok := claims["username"].(string)
+	user.name, ok = claims["username"].(string)
 	if !ok {
-		return "", errors.New("Claims.username is not a string")
+		return nil, errors.New("Claims.username is not a string")
 	}
-	return userName, nil
+	return user, nil
 }
 
 func main() {
@@ -759,10 +1824,21 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	if err = loadRatePolicies(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err = loadConfirmThreshold(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	loadOthersGroups()
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc(outputRelative, outputHandler)
 	http.HandleFunc(authRelative, authHandler)
 	http.HandleFunc(logoutRelative, logoutHandler)
+	http.HandleFunc(statusRelative, statusHandler)
+	http.HandleFunc(resumeRelative, resumeHandler)
 
 	if err = http.ListenAndServe(":"+port, nil); err != nil {
 		fmt.Println(err)
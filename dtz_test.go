@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/antonholmquist/jason"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The Exif time used by most tests.
+const testOrigTime = "2019:05:01 10:00:00"
+
+// A file description page with the given date field value.
+func testPage(date string) *revision {
+	return &revision{
+		content:   fmt.Sprintf("=={{int:filedesc}}==\n{{Information\n|description=Test\n|date=%s\n|source={{own}}\n|author=[[User:Example|Example]]\n}}\n", date),
+		timestamp: "2024-01-01T00:00:00Z",
+	}
+}
+
+func testOptions(t *testing.T, camera, location string) *options {
+	cameraZone, err := time.LoadLocation(camera)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localZone, err := time.LoadLocation(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &options{cameraZone: cameraZone, localZone: localZone, summary: defaultSummary}
+}
+
+// A request with the given form fields.
+func testRequest(form url.Values) *http.Request {
+	return &http.Request{Form: form}
+}
+
+// A page object from a query, as read by prepare, for a file uploaded
+// by uploader with the given Exif metadata and date field.
+func testFile(t *testing.T, uploader string, metadata map[string]string, date string) *jason.Object {
+	t.Helper()
+	var common []map[string]string
+	for name, value := range metadata {
+		common = append(common, map[string]string{"name": name, "value": value})
+	}
+	rev := testPage(date)
+	data, err := json.Marshal(map[string]interface{}{
+		"pageid":    1,
+		"imageinfo": []interface{}{map[string]interface{}{"user": uploader, "timestamp": "2024-01-01T00:00:00Z", "commonmetadata": common}},
+		"revisions": []interface{}{map[string]interface{}{"timestamp": rev.timestamp, "slots": map[string]interface{}{"main": map[string]string{"content": rev.content}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := jason.NewObjectFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// A planEdit test case: the date field value, and the new date field,
+// or "" if planEdit should skip or fail.
+type planEditTest struct {
+	date string
+	want string
+}
+
+func checkPlanEdits(t *testing.T, origTime string, opts *options, tests []planEditTest) {
+	t.Helper()
+	for _, test := range tests {
+		plan, err := planEdit(origTime, testPage(test.date), opts)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("planEdit(%q) succeeded, want an error", test.date)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("planEdit(%q) failed: %v", test.date, err)
+			continue
+		}
+		if want := testPage(test.want).content; plan.newText != want {
+			t.Errorf("planEdit(%q) gave\n%s\nwant\n%s", test.date, plan.newText, want)
+		}
+	}
+}
+
+func TestDateReplaceable(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", true},
+		{"2019:05:01 10:00:00", true},
+		{"2019-05-01 10:00:00", true},
+		{"2019-05-01T10:00:00", true},
+		{"2019-05-01T10:00", true},
+		{"{{According to Exif data|2019-05-01}}", true},
+		{"{{according to EXIF data|2019-05-01}}", true},
+		{"{{DTZ|2019-05-01T10:00:00+10}}", true},
+		{"2019-05-01T11:00:00", false},
+		{"1 May 2019", false},
+		{"{{Taken on|2019-05-01}}", false},
+	}
+	for _, test := range tests {
+		if got := dateReplaceable(test.value, testOrigTime); got != test.want {
+			t.Errorf("dateReplaceable(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPlanEdit(t *testing.T) {
+	tests := []planEditTest{
+		{"", "{{DTZ|2019-05-01T10:00:00+10}}"},
+		{"2019-05-01T10:00:00", "{{DTZ|2019-05-01T10:00:00+10}}"},
+		{"2019-05-01 10:00", "{{DTZ|2019-05-01T10:00:00+10}}"},
+		{"{{According to Exif data|2019-05-01 10:00}}", "{{DTZ|2019-05-01T10:00:00+10}}"},
+		{"{{DTZ|2019-05-01T10:00:00+09}}", "{{DTZ|2019-05-01T10:00:00+10}}"},
+		{"1 May 2019", ""},
+	}
+	checkPlanEdits(t, testOrigTime, testOptions(t, "Australia/Brisbane", "Australia/Brisbane"), tests)
+}
+
+func TestPlanEditOffsetOnly(t *testing.T) {
+	opts := testOptions(t, "Australia/Brisbane", "Australia/Brisbane")
+	opts.offsetOnly = true
+	plan, err := planEdit(testOrigTime, testPage("{{DTZ|2019-05-01T10:00:00+09}}"), opts)
+	if err != nil {
+		t.Fatalf("planEdit failed: %v", err)
+	}
+	want := "offset only changed from +09:00 to +10:00, instant moved by -1h0m0s"
+	if plan.result.change != want {
+		t.Errorf("change = %q, want %q", plan.result.change, want)
+	}
+	for _, date := range []string{"{{DTZ|2019-05-01T10:00:00+10}}", "{{DTZ|2019-05-01T09:00:00+10}}", "2019-05-01T10:00:00"} {
+		if _, err := planEdit(testOrigTime, testPage(date), opts); err == nil {
+			t.Errorf("planEdit(%q) succeeded, want it skipped", date)
+		}
+	}
+}
+
+func TestPlanEditFromWikitext(t *testing.T) {
+	opts := testOptions(t, "Europe/Berlin", "Europe/Berlin")
+	opts.fromWikitext = true
+	tests := []planEditTest{
+		{"2012-06-03T14:22", "{{DTZ|2012-06-03T14:22:00+02}}"},
+		{"2012-06-03 14:22:05", "{{DTZ|2012-06-03T14:22:05+02}}"},
+		{"{{Date|2012|6|3|14|22}}", "{{DTZ|2012-06-03T14:22:00+02}}"},
+		{"{{Taken on|2012-06-03T14:22|location=Germany}}", "{{DTZ|2012-06-03T14:22:00+02}}"},
+		{"{{DTZ|2012-06-03T14:22:00+02}}", ""},
+		{"June 2012", ""},
+	}
+	checkPlanEdits(t, "", opts, tests)
+	if _, err := planEdit("", testPage("{{DTZ|2012-06-03T14:22:00+02}}"), opts); err == nil || err.Error() != "date is already {{DTZ}}." {
+		t.Errorf("existing {{DTZ}} gave %v, want it skipped as already {{DTZ}}", err)
+	}
+}
+
+func TestRangesParam(t *testing.T) {
+	specs, err := rangesParam("IMG_0001.JPG | IMG_0050.JPG | 1000\nIMG_0051.JPG | IMG_0060.JPG | 1000 | 0200\nIMG_0061.JPG | IMG_0070.JPG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 3 {
+		t.Fatalf("got %d ranges, want 3", len(specs))
+	}
+	offset := func(zone *time.Location) int {
+		_, offset := time.Date(2020, 1, 1, 0, 0, 0, 0, zone).Zone()
+		return offset / 3600
+	}
+	if specs[0].cameraZone == nil || specs[0].localZone == nil || offset(specs[0].cameraZone) != 10 || offset(specs[0].localZone) != 10 {
+		t.Errorf("a single timezone should apply to both camera and location")
+	}
+	if offset(specs[1].cameraZone) != 10 || offset(specs[1].localZone) != 2 {
+		t.Errorf("two timezones should apply to camera and location in order")
+	}
+	if specs[2].cameraZone != nil || specs[2].localZone != nil {
+		t.Errorf("a range without timezones should use the job's")
+	}
+}
+
+func TestEditSummary(t *testing.T) {
+	opts := testOptions(t, "UTC", "Australia/Adelaide")
+	opts.jobID = 7
+	opts.jobStarted = time.Date(2024, 3, 1, 2, 30, 15, 0, time.UTC)
+	when := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	want := "Set date: UTC to Australia/Adelaide, offset +09:30 ([[toolforge:dtz|dtz]] job 7, 2024-03-01 02:30)"
+	if got := editSummary("Set date", when, opts); got != want {
+		t.Errorf("editSummary gave %q, want %q", got, want)
+	}
+	opts = testOptions(t, "Australia/Brisbane", "UTC")
+	if got := appliedOffset(when, opts); got != "-10:00" {
+		t.Errorf("appliedOffset gave %q, want -10:00", got)
+	}
+}
+
+func TestPlanEditShift(t *testing.T) {
+	tests := []struct {
+		camera, location string
+		date             string
+		shift            time.Duration
+	}{
+		{"UTC", "Australia/Brisbane", "2019-05-01 10:00:00", 10 * time.Hour},
+		{"UTC", "Australia/Brisbane", "{{DTZ|2019-05-01T20:00:00+11}}", time.Hour},
+		// Without a known old date, the offset applied is the shift.
+		{"UTC", "Australia/Brisbane", "", 10 * time.Hour},
+		{"UTC", "Australia/Brisbane", "{{According to Exif data|2019-05-01 10:00}}", 10 * time.Hour},
+		{"Pacific/Kiritimati", "Pacific/Pago_Pago", "", -25 * time.Hour},
+		{"Australia/Brisbane", "Australia/Brisbane", "{{According to Exif data|2019-05-01 10:00}}", 0},
+	}
+	for _, test := range tests {
+		opts := testOptions(t, test.camera, test.location)
+		plan, err := planEdit(testOrigTime, testPage(test.date), opts)
+		if err != nil {
+			t.Errorf("planEdit(%q) failed: %v", test.date, err)
+			continue
+		}
+		if plan.result.shift != test.shift {
+			t.Errorf("planEdit(%q) from %s to %s gave shift %v, want %v", test.date, test.camera, test.location, plan.result.shift, test.shift)
+		}
+		j := &job{breaker: breakerLimits{maxShift: defaultMaxShift}}
+		j.shifted(plan.result)
+		if want := test.shift > defaultMaxShift || test.shift < -defaultMaxShift; (j.largeShifts == 1) != want {
+			t.Errorf("planEdit(%q) from %s to %s counted %d large shifts, want large %v", test.date, test.camera, test.location, j.largeShifts, want)
+		}
+	}
+}
+
+func TestCaptureWindow(t *testing.T) {
+	opts := testOptions(t, "Australia/Brisbane", "Australia/Brisbane")
+	opts.user = "Example"
+	opts.captureStart = time.Date(2019, 5, 1, 8, 0, 0, 0, time.UTC)
+	opts.captureEnd = time.Date(2019, 5, 1, 23, 59, 59, 0, time.UTC)
+	tests := []struct {
+		origTime string
+		o        outcome // Zero if the file should be edited.
+	}{
+		{"2019:05:01 07:59:59", outcomeSkipped},
+		{"2019:05:01 08:00:00", ""},
+		{testOrigTime, ""},
+		{"2019:05:01 23:59:59", ""},
+		{"2019:05:02 00:00:00", outcomeSkipped},
+		{"2019:05:01", outcomeFailed},
+	}
+	for _, test := range tests {
+		p := prepare("File:Test.jpg", testFile(t, "Example", map[string]string{"DateTimeOriginal": test.origTime}, ""), opts, nil)
+		if p.o != test.o {
+			t.Errorf("prepare with time %s gave %q (%s), want %q", test.origTime, p.o, p.message, test.o)
+		}
+	}
+}
+
+func TestTitleMatches(t *testing.T) {
+	tests := []struct {
+		include, exclude string
+		title            string
+		want             bool
+	}{
+		{"", "", "File:IMG 0001.JPG", true},
+		{`^File:IMG_\d+\.JPG$`, "", "File:IMG_0001.JPG", true},
+		{`^File:IMG_\d+\.JPG$`, "", "File:IMG 0001.JPG", true},
+		{`^File:IMG_\d+\.JPG$`, "", "File:IMG_0001.jpg", false},
+		{`(?i)^File:IMG_\d+\.JPG$`, "", "File:IMG_0001.jpg", true},
+		{`^File:IMG_\d+\.JPG$`, "", "File:DSC_0001.JPG", false},
+		{"", "0001", "File:IMG_0001.JPG", false},
+		{"", "0001", "File:IMG_0002.JPG", true},
+		{`\.JPG$`, "IMG_0001", "File:IMG 0001.JPG", false},
+	}
+	for _, test := range tests {
+		opts := &options{}
+		var err error
+		if opts.includeTitle, err = regexpParam(test.include); err != nil {
+			t.Fatal(err)
+		}
+		if opts.excludeTitle, err = regexpParam(test.exclude); err != nil {
+			t.Fatal(err)
+		}
+		if got := titleMatches(test.title, opts); got != test.want {
+			t.Errorf("titleMatches(%q) with include %q, exclude %q = %v, want %v", test.title, test.include, test.exclude, got, test.want)
+		}
+	}
+	if _, err := regexpParam("IMG_("); err == nil {
+		t.Errorf("regexpParam accepted an invalid regular expression")
+	}
+}
+
+func TestLinkTargets(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"[[User:Example|Example]]", []string{"User:Example"}},
+		{"[[user:Example_Two|Someone else]]", []string{"user:Example Two"}},
+		{"[[:User:Example]] and [[ User:Colleague | a colleague ]]", []string{"User:Example", "User:Colleague"}},
+		{"{{User:Example/credit}}", []string{"User:Example/credit"}},
+		{"{{user:Example|size=small}}", []string{"user:Example"}},
+		{"Example", nil},
+	}
+	for _, test := range tests {
+		if got := linkTargets(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("linkTargets(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestAuthorMatches(t *testing.T) {
+	const mine = "[[User:Example|Example]]"
+	const colleague = "[[User:Colleague|Photo by Example's colleague]]"
+	tests := []struct {
+		form url.Values
+		text string
+		want bool
+	}{
+		{url.Values{"author": {"example"}}, mine, true},
+		{url.Values{"author": {"example"}}, colleague, true},
+		{url.Values{"author": {"user:example"}, "authormode": {matchExact}, "authorlinks": {"1"}}, mine, true},
+		{url.Values{"author": {"user:example"}, "authormode": {matchExact}, "authorlinks": {"1"}}, colleague, false},
+		{url.Values{"author": {"colleague"}, "authornot": {"1"}, "authorlinks": {"1"}}, mine, true},
+		{url.Values{"author": {"colleague"}, "authornot": {"1"}, "authorlinks": {"1"}}, colleague, false},
+		{url.Values{"author": {"colleague"}, "authornot": {"1"}}, mine, true},
+		{url.Values{"author": {`^User:Ex`}, "authormode": {matchRegexp}, "authorlinks": {"1"}}, mine, true},
+		{url.Values{"author": {`^User:Ex`}, "authormode": {matchRegexp}, "authorlinks": {"1"}}, "[[user:Example]]", false},
+	}
+	for _, test := range tests {
+		m, err := matcherParam("author", testRequest(test.form))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &options{author: m, authorLinks: test.form.Get("authorlinks") != ""}
+		if got := authorMatches(test.text, 0, len(test.text), opts); got != test.want {
+			t.Errorf("authorMatches(%q) with %v = %v, want %v", test.text, test.form, got, test.want)
+		}
+	}
+	if !authorMatches("", -1, -1, &options{}) {
+		t.Errorf("no author filter should match a missing author field")
+	}
+}
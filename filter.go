@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ways of matching a filter against a value.
+const (
+	matchSubstring = "substring"
+	matchExact     = "exact"
+	matchRegexp    = "regexp"
+)
+
+// A filter on a text value, such as an Exif field. Substring and exact
+// matches are case insensitive.
+type matcher struct {
+	mode   string
+	text   string // Lower case, for substring and exact matches.
+	re     *regexp.Regexp
+	negate bool
+}
+
+// Report whether a value passes the filter. A missing value is treated
+// as empty, so it passes negated filters.
+func (m *matcher) matches(value string) bool {
+	var found bool
+	switch m.mode {
+	case matchExact:
+		found = value != "" && strings.ToLower(value) == m.text
+	case matchRegexp:
+		found = value != "" && m.re.MatchString(value)
+	default:
+		found = value != "" && strings.Contains(strings.ToLower(value), m.text)
+	}
+	return found != m.negate
+}
+
+// Report whether any of several values, such as link targets, matches
+// the filter. If the filter is negated, reports whether none match.
+func (m *matcher) matchesAny(values []string) bool {
+	positive := *m
+	positive.negate = false
+	for _, value := range values {
+		if positive.matches(value) {
+			return !m.negate
+		}
+	}
+	return m.negate
+}
+
+// Read a filter from the form field name, with its mode in name+"mode"
+// and negation in name+"not". Returns nil if no filter was given.
+func matcherParam(name string, r *http.Request) (*matcher, error) {
+	text := trimmedField(name, r)
+	if text == "" {
+		return nil, nil
+	}
+	m := &matcher{mode: trimmedField(name+"mode", r), negate: trimmedField(name+"not", r) != ""}
+	switch m.mode {
+	case matchExact, "", matchSubstring:
+		if m.mode == "" {
+			m.mode = matchSubstring
+		}
+		m.text = strings.ToLower(text)
+	case matchRegexp:
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression %s: %v", strconv.Quote(text), err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("Unknown match mode %s.", strconv.Quote(m.mode))
+	}
+	return m, nil
+}
+
+// A filter on Exif data from commonmetadata. The first of the named
+// fields that's present is matched.
+type exifFilter struct {
+	label  string
+	fields []string
+	m      *matcher
+}
+
+// The Exif filters offered in the form, by form field name.
+var exifFilterFields = []struct {
+	name, label string
+	fields      []string
+}{
+	{"make", "camera make", []string{"Make"}},
+	{"model", "camera model", []string{"Model"}},
+	{"lens", "lens model", []string{"LensModel"}},
+	{"serial", "serial number", []string{"BodySerialNumber", "SerialNumber"}},
+	{"software", "software", []string{"Software"}},
+}
+
+func exifFiltersParam(r *http.Request) ([]exifFilter, error) {
+	var filters []exifFilter
+	for _, f := range exifFilterFields {
+		m, err := matcherParam(f.name, r)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			filters = append(filters, exifFilter{f.label, f.fields, m})
+		}
+	}
+	return filters, nil
+}
+
+// Check metadata values against the Exif filters, returning the label
+// of the first filter that fails, or "" if all pass.
+func failedExifFilter(metadata map[string]string, filters []exifFilter) string {
+	for _, f := range filters {
+		var value string
+		for _, field := range f.fields {
+			if v, ok := metadata[field]; ok {
+				value = v
+				break
+			}
+		}
+		if !f.m.matches(value) {
+			return f.label
+		}
+	}
+	return ""
+}
+
+// Write the form inputs for a filter read by matcherParam.
+func writeFilterInputs(w http.ResponseWriter, label, name string) {
+	writeString(w, label+` <input type="text" name="`+name+`" size="50">
+<select name="`+name+`mode"><option value="substring">contains</option><option value="exact">equals</option><option value="regexp">matches regexp</option></select>
+<input type="checkbox" name="`+name+`not" value="1"> not<br>
+`)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		text, mode string
+		negate     bool
+		value      string
+		want       bool
+	}{
+		{"canon", "", false, "Canon EOS 80D", true},
+		{"canon", matchSubstring, false, "NIKON D750", false},
+		{"canon", matchSubstring, true, "NIKON D750", true},
+		{"canon", matchSubstring, true, "", true},
+		{"canon", matchSubstring, false, "", false},
+		{"Canon EOS 80D", matchExact, false, "canon eos 80d", true},
+		{"Canon EOS", matchExact, false, "Canon EOS 80D", false},
+		{`^Canon EOS \d+D$`, matchRegexp, false, "Canon EOS 80D", true},
+		{`^Canon EOS \d+D$`, matchRegexp, false, "canon eos 80d", false},
+		{`^Canon`, matchRegexp, true, "Canon EOS 80D", false},
+	}
+	for _, test := range tests {
+		form := url.Values{"model": {test.text}, "modelmode": {test.mode}}
+		if test.negate {
+			form.Set("modelnot", "1")
+		}
+		m, err := matcherParam("model", testRequest(form))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.matches(test.value); got != test.want {
+			t.Errorf("%s %q (not %v) against %q = %v, want %v", m.mode, test.text, test.negate, test.value, got, test.want)
+		}
+	}
+	if m, err := matcherParam("model", testRequest(url.Values{"model": {" "}})); m != nil || err != nil {
+		t.Errorf("an empty filter gave %v, %v, want no filter", m, err)
+	}
+	for _, form := range []url.Values{{"model": {"("}, "modelmode": {matchRegexp}}, {"model": {"x"}, "modelmode": {"glob"}}} {
+		if _, err := matcherParam("model", testRequest(form)); err == nil {
+			t.Errorf("matcherParam(%v) succeeded, want an error", form)
+		}
+	}
+}
+
+func TestFailedExifFilter(t *testing.T) {
+	filters, err := exifFiltersParam(testRequest(url.Values{
+		"make":        {"canon"},
+		"serial":      {"012345"},
+		"serialmode":  {matchExact},
+		"software":    {"lightroom"},
+		"softwarenot": {"1"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		metadata map[string]string
+		want     string
+	}{
+		{map[string]string{"Make": "Canon", "BodySerialNumber": "012345"}, ""},
+		{map[string]string{"Make": "Canon", "SerialNumber": "012345"}, ""},
+		{map[string]string{"Make": "Canon", "BodySerialNumber": "012345", "SerialNumber": "999"}, ""},
+		{map[string]string{"Make": "Canon", "BodySerialNumber": "999", "SerialNumber": "012345"}, "serial number"},
+		{map[string]string{"Make": "NIKON CORPORATION", "BodySerialNumber": "012345"}, "camera make"},
+		{map[string]string{"Make": "Canon"}, "serial number"},
+		{map[string]string{"Make": "Canon", "BodySerialNumber": "012345", "Software": "Adobe Photoshop Lightroom"}, "software"},
+	}
+	for _, test := range tests {
+		if got := failedExifFilter(test.metadata, filters); got != test.want {
+			t.Errorf("failedExifFilter(%v) = %q, want %q", test.metadata, got, test.want)
+		}
+	}
+}
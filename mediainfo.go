@@ -0,0 +1,251 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Structured data on Commons is stored in a MediaInfo entity for each
+// file, with ID "M" followed by the file page ID.
+
+const inceptionProperty = "P571"
+const gregorianCalendar = "http://www.wikidata.org/entity/Q1985727"
+
+// Wikibase doesn't support a precision finer than a day, so times are
+// stored with day precision and a time of day of zero. The timezone
+// offset is part of the data model and is set, although it's not
+// displayed.
+const dayPrecision = 11
+
+type timeValue struct {
+	Time          string `json:"time"`
+	Timezone      int64  `json:"timezone"`
+	Before        int64  `json:"before"`
+	After         int64  `json:"after"`
+	Precision     int64  `json:"precision"`
+	CalendarModel string `json:"calendarmodel"`
+}
+
+func inceptionValue(t time.Time) timeValue {
+	_, offset := t.Zone()
+	return timeValue{
+		Time:          t.Format("+2006-01-02T00:00:00Z"),
+		Timezone:      int64(offset / 60),
+		Precision:     dayPrecision,
+		CalendarModel: gregorianCalendar,
+	}
+}
+
+// An existing inception statement. hasValue is false for "unknown
+// value" and "no value" statements.
+type statement struct {
+	id, rank string
+	hasValue bool
+	value    timeValue
+}
+
+func mediaInfoID(pageID string) string {
+	return "M" + pageID
+}
+
+// Get the inception statements from a MediaInfo entity.
+func getInception(id string, client *mwclient.Client) ([]statement, error) {
+	params := params.Values{
+		"action": "wbgetentities",
+		"ids":    id,
+		"props":  "claims",
+	}
+	resp, err := client.Get(params)
+	if err != nil {
+		return nil, err
+	}
+	entity, err := resp.GetObject("entities", id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := entity.GetValue("missing"); err == nil {
+		// No structured data has been added to the file yet.
+		return nil, nil
+	}
+	// MediaInfo entities use "statements" where items use "claims".
+	claims, err := entity.GetObjectArray("statements", inceptionProperty)
+	if err != nil {
+		claims, err = entity.GetObjectArray("claims", inceptionProperty)
+		if err != nil {
+			return nil, nil
+		}
+	}
+	result := make([]statement, len(claims))
+	for i, claim := range claims {
+		result[i].id, err = claim.GetString("id")
+		if err != nil {
+			return nil, err
+		}
+		result[i].rank, _ = claim.GetString("rank")
+		snakType, _ := claim.GetString("mainsnak", "snaktype")
+		if snakType != "value" {
+			continue
+		}
+		value, err := claim.GetObject("mainsnak", "datavalue", "value")
+		if err != nil {
+			return nil, err
+		}
+		result[i].hasValue = true
+		result[i].value.Time, _ = value.GetString("time")
+		result[i].value.Timezone, _ = value.GetInt64("timezone")
+		result[i].value.Before, _ = value.GetInt64("before")
+		result[i].value.After, _ = value.GetInt64("after")
+		result[i].value.Precision, _ = value.GetInt64("precision")
+		result[i].value.CalendarModel, _ = value.GetString("calendarmodel")
+	}
+	return result, nil
+}
+
+// Report whether an existing time value includes the instant t, at the
+// value's own precision and timezone. Only year, month and day
+// precisions in the Gregorian calendar are recognised.
+func inceptionIncludes(v timeValue, t time.Time) bool {
+	lengths := map[int64]int{9: len("+2006"), 10: len("+2006-01"), 11: len("+2006-01-02")}
+	n, ok := lengths[v.Precision]
+	if !ok || v.CalendarModel != gregorianCalendar || len(v.Time) < n {
+		return false
+	}
+	want := inceptionValue(t.In(time.FixedZone("", int(v.Timezone)*60))).Time
+	return v.Time[:n] == want[:n]
+}
+
+func formatTimeValue(v timeValue) string {
+	lengths := map[int64]int{9: len("+2006"), 10: len("+2006-01")}
+	n, ok := lengths[v.Precision]
+	if !ok || len(v.Time) < n {
+		n = len("+2006-01-02")
+	}
+	if len(v.Time) < n {
+		return v.Time
+	}
+	offset := time.Date(2000, 1, 1, 0, 0, 0, 0, time.FixedZone("", int(v.Timezone)*60))
+	return v.Time[1:n] + " (UTC" + formatOffset(offset) + ")"
+}
+
+// Set the inception statement of a file to the date of t, creating the
+// statement if needed. An existing statement with a different value is
+// only replaced if opts.overwrite is set. Returns a description of what
+// was done.
+func setInception(pageID string, t time.Time, summary string, opts *options, limiter *rateLimiter, client *mwclient.Client) (string, outcome, error) {
+	id := mediaInfoID(pageID)
+	statements, err := getInception(id, client)
+	if err != nil {
+		return "", outcomeFailed, err
+	}
+	if len(statements) > 1 {
+		return "", outcomeFailed, errors.New("multiple inception statements.")
+	}
+	value := inceptionValue(t)
+	if len(statements) == 1 && statements[0].hasValue && statements[0].value == value {
+		return "inception already set", outcomeUnchanged, nil
+	}
+	// As with the date field, an existing value may have been
+	// entered by hand, so it's only replaced if requested.
+	if len(statements) == 1 && !opts.overwrite {
+		if !statements[0].hasValue {
+			return "inception has no value, not replaced", outcomeSkipped, nil
+		}
+		return "inception " + formatTimeValue(statements[0].value) + " appears curated, not replaced", outcomeSkipped, nil
+	}
+	saved, err := saveInception(id, statements, value, summary, opts, limiter, client)
+	if err != nil {
+		return "", errorOutcome(err), err
+	}
+	return saved, outcomeEdited, nil
+}
+
+// Compare the inception statement of a file with the instant t, and
+// if fix is true, replace it if it's missing or disagrees. Returns a
+// description of the comparison and what was done.
+func reconcileInception(pageID string, t time.Time, fix bool, summary string, opts *options, limiter *rateLimiter, client *mwclient.Client) (string, outcome, error) {
+	id := mediaInfoID(pageID)
+	statements, err := getInception(id, client)
+	if err != nil {
+		return "", outcomeFailed, err
+	}
+	if len(statements) > 1 {
+		return "", outcomeFailed, errors.New("multiple inception statements.")
+	}
+	value := inceptionValue(t)
+	var report string
+	switch {
+	case len(statements) == 0:
+		report = "no inception, Exif gives " + formatTimeValue(value)
+	case !statements[0].hasValue:
+		// "No value" or "unknown value" was chosen deliberately.
+		return "inception has no value, skipped", outcomeSkipped, nil
+	case statements[0].value == value:
+		return "inception agrees with Exif", outcomeUnchanged, nil
+	case inceptionIncludes(statements[0].value, t) && statements[0].value.Precision < dayPrecision:
+		return "inception " + formatTimeValue(statements[0].value) + " agrees with Exif at lower precision", outcomeUnchanged, nil
+	case inceptionIncludes(statements[0].value, t):
+		report = "inception " + formatTimeValue(statements[0].value) + " agrees with Exif, but the offset differs from " + formatTimeValue(value)
+	default:
+		report = "inception " + formatTimeValue(statements[0].value) + " disagrees with Exif " + formatTimeValue(value)
+	}
+	if !fix {
+		return report, outcomeReported, nil
+	}
+	saved, err := saveInception(id, statements, value, summary, opts, limiter, client)
+	if err != nil {
+		return "", errorOutcome(err), err
+	}
+	return report + "; " + saved, outcomeEdited, nil
+}
+
+// Add an inception statement, or replace the value of the single
+// existing statement.
+func saveInception(id string, statements []statement, value timeValue, summary string, opts *options, limiter *rateLimiter, client *mwclient.Client) (string, error) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	var editParams params.Values
+	if len(statements) == 0 {
+		editParams = params.Values{
+			"action":   "wbcreateclaim",
+			"entity":   id,
+			"property": inceptionProperty,
+			"snaktype": "value",
+			"value":    string(valueJSON),
+			"summary":  summary,
+		}
+	} else {
+		// Only the main value is changed, keeping the rank,
+		// qualifiers and references.
+		editParams = params.Values{
+			"action":   "wbsetclaimvalue",
+			"claim":    statements[0].id,
+			"snaktype": "value",
+			"value":    string(valueJSON),
+			"summary":  summary,
+		}
+	}
+	save := func() error {
+		// Fetch the token for each attempt, in case a bad token was
+		// dropped from the cache.
+		token, err := client.GetToken(mwclient.CSRFToken)
+		if err != nil {
+			return err
+		}
+		editParams["token"] = token
+		addEditParams(editParams, opts)
+		_, err = client.Post(editParams)
+		return err
+	}
+	if err := saveWithRetries(save, nil, limiter, client); err != nil {
+		return "", err
+	}
+	if len(statements) == 0 {
+		return "inception added", nil
+	}
+	return "inception updated", nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"context"
+	"fmt"
+	"github.com/antonholmquist/jason"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// Files are processed in two stages. A pool of goroutines reads ahead,
+// fetching pages and preparing the new wikitext, while the editor saves
+// the edits one at a time at the rate allowed by policy. The editor
+// receives the prepared files in the order they were selected, and
+// writes all the output.
+
+// The number of goroutines preparing files.
+const prepareWorkers = 4
+
+// The number of files that can be waiting for the editor. When the
+// queue is full, the selection queries wait too.
+const readAhead = 20
+
+// A file that's ready for the editor, or a note to be written to the
+// output in sequence.
+type prepared struct {
+	note        string // HTML to write, if this isn't a file.
+	title       string
+	opts        *options
+	o           outcome // If set, the file needs no edit and message is its outcome.
+	message     string
+	pageID      string
+	origTime    string
+	plan        editPlan
+	planErr     error  // errNoChange if only the inception may need setting.
+	implausible string // Why the Exif time is implausible, if edited anyway.
+}
+
+// State of a run of the tool, which may involve several queries.
+type job struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	opts    *options // Not changed once the job runs; ranges have their own.
+	breaker breakerLimits
+	client  *mwclient.Client
+	w       http.ResponseWriter
+	flusher http.Flusher
+	limiter rateLimiter
+	status  *jobStatus
+	seen    map[string]bool // Files already queued, in case queries overlap.
+	counts  map[outcome]int
+	// Counts for pausing the job, since it started or was resumed.
+	failures, largeShifts int
+	queue                 chan chan *prepared
+	workers               chan struct{} // Semaphore for the read-ahead goroutines.
+}
+
+func startJob(ctx context.Context, opts *options, client *mwclient.Client, w http.ResponseWriter) *job {
+	writeString(w, "<p>To stop this tool, press the browser stop button, close the page, or revoke OAuth access at ")
+	writeLink(w, oauthManageURL, "Special:OAuthManageMyGrants")
+	writeString(w, ".</p><p>\n")
+	flusher, haveFlush := w.(http.Flusher)
+	if !haveFlush {
+		writeString(w, "Expected a flush method.")
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	queue := make(chan chan *prepared, readAhead)
+	status := editScheduler.register(opts.user, opts.editInterval, queue)
+	opts.jobID, opts.jobStarted = status.id, status.started
+	return &job{
+		ctx:     ctx,
+		cancel:  cancel,
+		opts:    opts,
+		breaker: opts.breaker,
+		client:  client,
+		w:       w,
+		flusher: flusher,
+		limiter: rateLimiter{ctx: ctx, status: status},
+		status:  status,
+		seen:    make(map[string]bool),
+		counts:  make(map[outcome]int),
+		queue:   queue,
+		workers: make(chan struct{}, prepareWorkers),
+	}
+}
+
+// Run the selection queries in produce, which queue files with
+// processPage, while committing the prepared files in order. Stops
+// early if the browser connection is lost.
+func (j *job) run(produce func()) {
+	go func() {
+		defer close(j.queue)
+		produce()
+	}()
+	for done := range j.queue {
+		var p *prepared
+		select {
+		case p = <-done:
+		case <-j.ctx.Done():
+		}
+		if p == nil || !j.commit(p) || !j.checkBreaker() {
+			j.cancel()
+			break
+		}
+		j.flusher.Flush()
+	}
+	// Let the producer finish if it's waiting on the queue.
+	for range j.queue {
+	}
+}
+
+// Add an item to the queue. Returns false if the job was cancelled.
+func (j *job) enqueue(done chan *prepared) bool {
+	select {
+	case j.queue <- done:
+		return true
+	case <-j.ctx.Done():
+		return false
+	}
+}
+
+// Queue HTML to be written in sequence with the files. Returns false
+// if the job was cancelled.
+func (j *job) note(text string) bool {
+	done := make(chan *prepared, 1)
+	done <- &prepared{note: text}
+	return j.enqueue(done)
+}
+
+// Queue a file that has already finished, without preparing it.
+func (j *job) finished(title string, o outcome, message string) bool {
+	done := make(chan *prepared, 1)
+	done <- &prepared{title: title, opts: j.opts, o: o, message: message}
+	return j.enqueue(done)
+}
+
+// Queue a page object from a query with imageinfo, and start preparing
+// it. Returns false if the job was cancelled.
+func (j *job) processPage(page *jason.Object, opts *options) bool {
+	obj, err := page.Object()
+	if err != nil {
+		return j.note("Skipped an item with missing pages object.<br>\n")
+	}
+	title, err := obj.GetString("title")
+	if err != nil {
+		return j.note("Skipped an item with no title.<br>\n")
+	}
+	if j.seen[title] {
+		return true
+	}
+	j.seen[title] = true
+	if opts.exclude[title] {
+		return j.finished(title, outcomeExcluded, "excluded.")
+	}
+	if !titleMatches(title, opts) {
+		return j.finished(title, outcomeFiltered, "title filtered.")
+	}
+	done := make(chan *prepared, 1)
+	if !j.enqueue(done) {
+		return false
+	}
+	select {
+	case j.workers <- struct{}{}:
+	case <-j.ctx.Done():
+		return false
+	}
+	go func() {
+		defer func() { <-j.workers }()
+		done <- prepare(title, obj, opts, j.client)
+	}()
+	return true
+}
+
+// Write the outcome for a file. Returns false if the connection to the
+// browser was lost.
+func (j *job) report(o outcome, message string) bool {
+	j.counts[o]++
+	if isFailure(o) {
+		j.failures++
+	}
+	return writeString(j.w, html.EscapeString(message)+"<br>\n") == nil
+}
+
+func (j *job) finish() {
+	j.cancel()
+	editScheduler.unregister(j.status)
+	var parts []string
+	for _, o := range outcomes {
+		if j.counts[o] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", j.counts[o], o))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "no files processed")
+	}
+	writeString(j.w, "</p>\n<p>Summary: "+strings.Join(parts, ", ")+".</p>\n")
+	writeString(j.w, "</body></html>")
+}
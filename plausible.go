@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exif times can be nonsense, e.g., when a camera's clock was reset
+// because its battery ran down. Files with implausible times are
+// skipped, or optionally edited anyway with a warning in the output.
+
+// Checks for implausible Exif times. A time of zero is always
+// implausible.
+type plausibilityChecks struct {
+	minYear     int  // Times before this year are implausible. Zero for no limit; defaultMinYear if left blank.
+	resetDates  bool // Times on dates that cameras reset to.
+	future      bool // Times in the future.
+	afterUpload bool // Times after the file was uploaded.
+	flagOnly    bool // Edit files with implausible times, with a warning.
+}
+
+const defaultMinYear = 1990
+
+// Dates that camera clocks commonly reset to, in Exif format.
+var resetDates = []string{"1970:01:01", "1980:01:01", "2000:01:01"}
+
+func plausibilityParam(r *http.Request) (plausibilityChecks, error) {
+	minYear, err := countParam("minyear", defaultMinYear, r)
+	if err != nil {
+		return plausibilityChecks{}, err
+	}
+	return plausibilityChecks{
+		minYear:     minYear,
+		resetDates:  trimmedField("checkreset", r) != "",
+		future:      trimmedField("checkfuture", r) != "",
+		afterUpload: trimmedField("checkupload", r) != "",
+		flagOnly:    trimmedField("implausible", r) == "flag",
+	}, nil
+}
+
+// Report whether an Exif time is zero, as written by some cameras when
+// the time isn't set.
+func zeroTime(origTime string) bool {
+	return strings.HasPrefix(origTime, "0000:00:00")
+}
+
+// Check an Exif time against the plausibility checks, returning the
+// reason it's implausible, or "" if it passes. uploaded is the upload
+// time of the file, or zero if unknown.
+func implausible(origTime string, uploaded time.Time, opts *options) string {
+	checks := opts.plausibility
+	if zeroTime(origTime) {
+		return "the date is zero"
+	}
+	if checks.resetDates {
+		for _, date := range resetDates {
+			if strings.HasPrefix(origTime, date) {
+				return "a date that camera clocks reset to"
+			}
+		}
+	}
+	t, err := time.ParseInLocation(exifFormat, origTime, opts.cameraZone)
+	if err != nil {
+		// Reported when the time is converted.
+		return ""
+	}
+	switch {
+	case checks.minYear > 0 && t.Year() < checks.minYear:
+		return "before " + strconv.Itoa(checks.minYear)
+	case checks.future && t.After(time.Now()):
+		return "in the future"
+	case checks.afterUpload && !uploaded.IsZero() && t.After(uploaded):
+		return "after the upload time " + uploaded.Format(exifFormat) + " UTC"
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPlausibilityParam(t *testing.T) {
+	tests := []struct {
+		minyear string
+		want    int
+		fails   bool
+	}{
+		{"", defaultMinYear, false},
+		{" ", defaultMinYear, false},
+		{"0", 0, false},
+		{"2005", 2005, false},
+		{"-1", 0, true},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		checks, err := plausibilityParam(testRequest(url.Values{"minyear": {test.minyear}}))
+		if (err != nil) != test.fails || checks.minYear != test.want {
+			t.Errorf("plausibilityParam with minyear %q gave %d, %v, want %d (error %v)", test.minyear, checks.minYear, err, test.want, test.fails)
+		}
+	}
+}
+
+func TestImplausible(t *testing.T) {
+	all := plausibilityChecks{minYear: defaultMinYear, resetDates: true, future: true, afterUpload: true}
+	uploaded := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	future := time.Now().AddDate(1, 0, 0).Format(exifFormat)
+	tests := []struct {
+		checks   plausibilityChecks
+		origTime string
+		uploaded time.Time
+		want     string
+	}{
+		{all, testOrigTime, uploaded, ""},
+		{all, "0000:00:00 00:00:00", uploaded, "the date is zero"},
+		{plausibilityChecks{}, "0000:00:00 00:00:00", uploaded, "the date is zero"},
+		{all, "1970:01:01 00:00:12", uploaded, "a date that camera clocks reset to"},
+		{all, "2000:01:01 09:30:00", uploaded, "a date that camera clocks reset to"},
+		{plausibilityChecks{minYear: defaultMinYear}, "2000:01:01 09:30:00", uploaded, ""},
+		{all, "1989:12:31 23:59:59", uploaded, "before 1990"},
+		{all, "1990:01:01 00:00:00", uploaded, ""},
+		{plausibilityChecks{}, "1975:06:01 12:00:00", uploaded, ""},
+		{all, future, time.Time{}, "in the future"},
+		{plausibilityChecks{}, future, uploaded, ""},
+		// The camera is at UTC+10, so this is a second after the upload.
+		{all, "2019:06:01 10:00:01", uploaded, "after the upload time 2019:06:01 00:00:00 UTC"},
+		{all, "2019:06:01 10:00:00", time.Time{}, ""},
+		{all, "not a time", uploaded, ""},
+	}
+	for _, test := range tests {
+		opts := testOptions(t, "Australia/Brisbane", "Australia/Brisbane")
+		opts.plausibility = test.checks
+		if got := implausible(test.origTime, test.uploaded, opts); got != test.want {
+			t.Errorf("implausible(%q) with %+v = %q, want %q", test.origTime, test.checks, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The number of times a save is attempted when it fails with a
+// transient error.
+const maxSaveAttempts = 5
+
+// An error from saving an edit, with the outcome it's counted as.
+type saveError struct {
+	o   outcome
+	err error
+}
+
+func (e saveError) Error() string {
+	return fmt.Sprintf("failed to save (%s): %v", e.o, e.err)
+}
+
+// An edit that the API didn't save, e.g., because of an abuse filter,
+// with the code from the edit result.
+type editFailure struct {
+	result, code, info string
+}
+
+func (e editFailure) Error() string {
+	if e.code == "" {
+		return "edit result " + e.result
+	}
+	return fmt.Sprintf("edit result %s: %s: %s", e.result, e.code, e.info)
+}
+
+// Save wikitext with action=edit. This is like Client.Edit, but returns
+// an editFailure with the result code if the edit isn't saved.
+func postEdit(p params.Values, client *mwclient.Client) error {
+	if p["token"] == "" {
+		token, err := client.GetToken(mwclient.CSRFToken)
+		if err != nil {
+			return err
+		}
+		p["token"] = token
+	}
+	p["action"] = "edit"
+	resp, err := client.Post(p)
+	if _, isWarning := err.(mwclient.APIWarnings); err != nil && !isWarning {
+		return err
+	}
+	result, err := resp.GetString("edit", "result")
+	if err != nil {
+		return errors.New("no result in edit response.")
+	}
+	if result != "Success" {
+		code, _ := resp.GetString("edit", "code")
+		info, _ := resp.GetString("edit", "info")
+		if _, err := resp.GetValue("edit", "captcha"); err == nil {
+			code = "captcha"
+		}
+		return editFailure{result, code, info}
+	}
+	if nochange, err := resp.GetBoolean("edit", "nochange"); err == nil && nochange {
+		return mwclient.ErrEditNoChange
+	}
+	return nil
+}
+
+// Work out the outcome of an error from saving an edit, and whether
+// it's worth trying again.
+func classifySaveError(err error) (outcome, bool) {
+	if err == mwclient.ErrAPIBusy {
+		// mwclient has already waited and retried for maxlag.
+		return outcomeMaxlag, true
+	}
+	var code string
+	switch e := err.(type) {
+	case mwclient.APIError:
+		code = e.Code
+	case editFailure:
+		code = e.code
+	default:
+		// Probably a network error.
+		return outcomeFailed, true
+	}
+	switch {
+	case code == "editconflict":
+		return outcomeConflict, true
+	case code == "maxlag":
+		return outcomeMaxlag, true
+	case code == "ratelimited":
+		return outcomeRateLimited, true
+	case code == "badtoken":
+		return outcomeBadToken, true
+	case code == "readonly":
+		return outcomeReadOnly, true
+	case code == "protectedpage" || code == "cascadeprotected" || code == "protectednamespace" || code == "permissiondenied":
+		return outcomeProtected, false
+	case strings.HasPrefix(code, "abusefilter"):
+		return outcomeAbuseFilter, false
+	}
+	return outcomeFailed, false
+}
+
+// Call save, which makes one edit, retrying transient errors with
+// exponential backoff. On an edit conflict, replan is called before
+// trying again, and any error it returns is returned as is; if replan
+// is nil, conflicts aren't retried. Returns errNoChange if the edit
+// didn't change the page.
+func saveWithRetries(save func() error, replan func() error, limiter *rateLimiter, client *mwclient.Client) error {
+	for attempt := 1; ; attempt++ {
+		if err := limiter.wait(); err != nil {
+			return err
+		}
+		err := save()
+		limiter.edited()
+		if err == mwclient.ErrEditNoChange {
+			return errNoChange
+		}
+		if _, isWarning := err.(mwclient.APIWarnings); err == nil || isWarning {
+			return nil
+		}
+		o, transient := classifySaveError(err)
+		if !transient || attempt == maxSaveAttempts || (o == outcomeConflict && replan == nil) {
+			return saveError{o, err}
+		}
+		switch o {
+		case outcomeConflict:
+			if err := replan(); err != nil {
+				return err
+			}
+		case outcomeBadToken:
+			// The session may have changed; fetch a new token.
+			delete(client.Tokens, mwclient.CSRFToken)
+		}
+		delay := limiter.status.interval << uint(attempt-1)
+		if o == outcomeMaxlag || o == outcomeReadOnly {
+			// The servers are struggling, so hold back every job.
+			editScheduler.pause(delay)
+		} else {
+			limiter.backoff(delay)
+		}
+	}
+}
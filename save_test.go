@@ -0,0 +1,49 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifySaveError(t *testing.T) {
+	tests := []struct {
+		err       error
+		o         outcome
+		transient bool
+	}{
+		{mwclient.APIError{Code: "editconflict"}, outcomeConflict, true},
+		{mwclient.APIError{Code: "ratelimited"}, outcomeRateLimited, true},
+		{mwclient.APIError{Code: "badtoken"}, outcomeBadToken, true},
+		{mwclient.APIError{Code: "protectedpage"}, outcomeProtected, false},
+		{mwclient.APIError{Code: "abusefilter-disallowed"}, outcomeAbuseFilter, false},
+		{mwclient.ErrAPIBusy, outcomeMaxlag, true},
+		{editFailure{"Failure", "abusefilter-warning", "Warning"}, outcomeAbuseFilter, false},
+		{editFailure{"Failure", "captcha", ""}, outcomeFailed, false},
+		{errors.New("connection reset"), outcomeFailed, true},
+	}
+	for _, test := range tests {
+		o, transient := classifySaveError(test.err)
+		if o != test.o || transient != test.transient {
+			t.Errorf("classifySaveError(%v) = %s, %v, want %s, %v", test.err, o, transient, test.o, test.transient)
+		}
+	}
+}
+
+func TestPostEditFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"edit":{"result":"Failure","code":"abusefilter-disallowed","info":"Hit filter"}}`))
+	}))
+	defer server.Close()
+	client, err := mwclient.New(server.URL, "dtz test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = postEdit(params.Values{"title": "File:Test.jpg", "text": "Test", "token": "x"}, client)
+	if o, _ := classifySaveError(err); o != outcomeAbuseFilter {
+		t.Errorf("postEdit gave %v, classified as %s, want %s", err, o, outcomeAbuseFilter)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Edits from all jobs go through one scheduler, so that running several
+// jobs at once, for one user or for many, doesn't multiply the tool's
+// edit rate. Each user is limited to the interval given by their rate
+// policy, and the tool as a whole to one edit per toolEditInterval.
+
+// Edits are limited to one per 5 seconds per user, per Commons bot
+// policy, unless the user is in a group that's allowed more.
+const editInterval = 5 * time.Second
+
+const toolEditInterval = time.Second
+
+// The interval between edits allowed for members of a user group.
+type ratePolicy struct {
+	group    string
+	interval time.Duration
+}
+
+// Rate policies, checked in order. Users in none of the groups get
+// editInterval. May be replaced with the RatePolicies environment
+// variable, e.g., "bot=1s,flood=2s".
+var ratePolicies = []ratePolicy{
+	{"bot", time.Second},
+	{"flood", time.Second},
+}
+
+func loadRatePolicies() error {
+	config := os.Getenv("RatePolicies")
+	if config == "" {
+		return nil
+	}
+	var policies []ratePolicy
+	for _, item := range strings.Split(config, ",") {
+		fields := strings.Split(item, "=")
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid rate policy %s, expected group=interval.", strconv.Quote(item))
+		}
+		interval, err := time.ParseDuration(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return fmt.Errorf("Invalid rate policy %s: %v", strconv.Quote(item), err)
+		}
+		policies = append(policies, ratePolicy{strings.TrimSpace(fields[0]), interval})
+	}
+	ratePolicies = policies
+	return nil
+}
+
+// The interval between edits allowed for a user.
+func userInterval(user *userInfo) time.Duration {
+	for _, policy := range ratePolicies {
+		if user.inGroup(policy.group) {
+			return policy.interval
+		}
+	}
+	return editInterval
+}
+
+// Describe an edit interval, e.g., "one per 5 seconds".
+func describeInterval(d time.Duration) string {
+	switch {
+	case d == time.Second:
+		return "one per second"
+	case d%time.Second == 0:
+		return fmt.Sprintf("one per %d seconds", d/time.Second)
+	}
+	return "one per " + d.String()
+}
+
+// Describe the edit rates allowed by the rate policies, for the form.
+func describeRates() string {
+	var intervals []time.Duration
+	groups := make(map[time.Duration][]string)
+	for _, policy := range ratePolicies {
+		if groups[policy.interval] == nil {
+			intervals = append(intervals, policy.interval)
+		}
+		groups[policy.interval] = append(groups[policy.interval], policy.group)
+	}
+	text := "Edits are limited to " + describeInterval(editInterval) + " per user"
+	for _, interval := range intervals {
+		noun := " group"
+		if len(groups[interval]) > 1 {
+			noun = " groups"
+		}
+		text += ", or " + describeInterval(interval) + " for members of the " + strings.Join(groups[interval], " or ") + noun
+	}
+	return text + "."
+}
+
+type scheduler struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	next     time.Time            // Next slot by the tool-wide rate.
+	paused   time.Time            // No edits by any job before this time.
+	userNext map[string]time.Time // No edits by a user before this time.
+	lastID   int
+	jobs     map[int]*jobStatus
+}
+
+// A running job, as shown on the status page.
+type jobStatus struct {
+	id       int
+	user     string
+	interval time.Duration // Between edits by this job's user.
+	started  time.Time
+	queue    chan chan *prepared
+	saves    int  // Attempts to save an edit.
+	waiting  bool // Waiting for its turn to edit.
+	paused   bool // Waiting for the user to resume.
+	resume   chan struct{}
+}
+
+var editScheduler = newScheduler(time.Now)
+
+// Make a scheduler that reads the time from now, which is replaced in
+// tests.
+func newScheduler(now func() time.Time) *scheduler {
+	return &scheduler{
+		now:      now,
+		userNext: make(map[string]time.Time),
+		jobs:     make(map[int]*jobStatus),
+	}
+}
+
+// Add a job to the registry, returning its status.
+func (s *scheduler) register(user string, interval time.Duration, queue chan chan *prepared) *jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	st := &jobStatus{id: s.lastID, user: user, interval: interval, started: s.now(), queue: queue}
+	s.jobs[st.id] = st
+	return st
+}
+
+func (s *scheduler) unregister(st *jobStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, st.id)
+	now := s.now()
+	for user, next := range s.userNext {
+		if next.Before(now) {
+			delete(s.userNext, user)
+		}
+	}
+}
+
+// Reserve the next edit slot that's allowed for a job, returning its
+// time.
+func (s *scheduler) reserve(st *jobStatus) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := s.now()
+	if s.next.After(slot) {
+		slot = s.next
+	}
+	if s.paused.After(slot) {
+		slot = s.paused
+	}
+	if next := s.userNext[st.user]; next.After(slot) {
+		slot = next
+	}
+	s.next = slot.Add(toolEditInterval)
+	s.userNext[st.user] = slot.Add(st.interval)
+	st.waiting = true
+	return slot
+}
+
+// Record that a job has finished waiting, and whether it saved.
+func (s *scheduler) waited(st *jobStatus, saved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.waiting = false
+	if saved {
+		st.saves++
+	}
+}
+
+// Mark a job as paused, returning a channel that's closed when the user
+// resumes it.
+func (s *scheduler) pauseJob(st *jobStatus) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.paused = true
+	st.resume = make(chan struct{})
+	return st.resume
+}
+
+// Resume a paused job on behalf of a user, who must be the one running
+// it.
+func (s *scheduler) resumeJob(id int, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.jobs[id]
+	switch {
+	case !ok:
+		return fmt.Errorf("Job %d isn't running.", id)
+	case st.user != user:
+		return fmt.Errorf("Job %d was started by another user.", id)
+	case !st.paused:
+		return fmt.Errorf("Job %d isn't paused.", id)
+	}
+	st.paused = false
+	close(st.resume)
+	return nil
+}
+
+// Delay the next edit by any job until at least d from now, e.g.,
+// because the servers are lagged or asked for a Retry-After delay.
+func (s *scheduler) pause(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until := s.now().Add(d); until.After(s.paused) {
+		s.paused = until
+	}
+}
+
+// Delay the next edit by a user until at least d from now.
+func (s *scheduler) pauseUser(user string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until := s.now().Add(d); until.After(s.userNext[user]) {
+		s.userNext[user] = until
+	}
+}
+
+// A job's handle on the scheduler.
+type rateLimiter struct {
+	ctx    context.Context
+	status *jobStatus
+}
+
+// Wait until the job's next edit is allowed. Returns an error if the
+// job is cancelled first.
+func (l *rateLimiter) wait() error {
+	dur := editScheduler.reserve(l.status).Sub(editScheduler.now())
+	if dur <= 0 {
+		if err := l.ctx.Err(); err != nil {
+			editScheduler.waited(l.status, false)
+			return err
+		}
+		return nil
+	}
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-l.ctx.Done():
+		editScheduler.waited(l.status, false)
+		return l.ctx.Err()
+	}
+}
+
+// Record that an edit was attempted.
+func (l *rateLimiter) edited() {
+	editScheduler.waited(l.status, true)
+}
+
+// Delay the job's next edit by at least d, after an error.
+func (l *rateLimiter) backoff(d time.Duration) {
+	editScheduler.pauseUser(l.status.user, d)
+}
+
+// Wraps the transport of the HTTP client used for the API, so that all
+// jobs pause when the servers ask for a delay with Retry-After.
+type retryAfterTransport struct {
+	base http.RoundTripper
+	s    *scheduler
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		if d := retryAfter(resp.Header.Get("Retry-After"), t.s.now()); d > 0 {
+			t.s.pause(d)
+		}
+	}
+	return resp, err
+}
+
+// Parse a Retry-After header, which is either a number of seconds or an
+// HTTP date, returning the delay from now, or zero if there's none.
+func retryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Show the state of the scheduler. Anyone can see the totals; users
+// who are logged in also see their own jobs.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	var user *userInfo
+	if accessToken, err := r.Cookie(tokenCookie); err == nil {
+		if accessSecret, err := r.Cookie(secretCookie); err == nil {
+			if client, err := mwclient.New(commonsPrefix+"w/api.php", "dtz; User:Ghouston"); err == nil {
+				user, _ = authClient(client, accessToken.Value, accessSecret.Value)
+			}
+		}
+	}
+	editScheduler.mu.Lock()
+	statuses := make([]jobStatus, 0, len(editScheduler.jobs))
+	for _, st := range editScheduler.jobs {
+		statuses = append(statuses, *st)
+	}
+	paused := editScheduler.paused.Sub(editScheduler.now())
+	editScheduler.mu.Unlock()
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].id < statuses[k].id })
+
+	queued, waiting, pausedJobs := 0, 0, 0
+	var own []jobStatus
+	for _, st := range statuses {
+		queued += len(st.queue)
+		if st.waiting {
+			waiting++
+		}
+		if st.paused {
+			pausedJobs++
+		}
+		if user != nil && st.user == user.name {
+			own = append(own, st)
+		}
+	}
+	writeHead(w, "dtz status")
+	writeString(w, "<body>\n<h1>dtz status</h1>\n")
+	writeString(w, fmt.Sprintf("<p>%d jobs running, %d files queued, %d jobs waiting to edit, %d jobs paused.", len(statuses), queued, waiting, pausedJobs))
+	if paused > 0 {
+		writeString(w, fmt.Sprintf(" Edits are paused for %d seconds.", int(paused.Seconds())))
+	}
+	writeString(w, "</p>\n")
+	if user == nil {
+		writeString(w, "<p>")
+		writeLink(w, authRelative, "Log in")
+		writeString(w, " to see your own jobs.</p>\n</body></html>")
+		return
+	}
+	if len(own) == 0 {
+		writeString(w, "<p>You have no jobs running.</p>\n</body></html>")
+		return
+	}
+	writeString(w, "<table>\n<tr><th>Job</th><th>Started</th><th>Queued</th><th>Saves</th><th>State</th></tr>\n")
+	for _, st := range own {
+		state := "preparing"
+		if st.waiting {
+			state = "waiting to edit"
+		}
+		if st.paused {
+			state = "paused"
+		}
+		writeString(w, fmt.Sprintf("<tr><td>%d</td><td>%s</td><td>%d</td><td>%d</td><td>%s</td></tr>\n",
+			st.id, st.started.UTC().Format("2006-01-02 15:04:05"), len(st.queue), st.saves, state))
+	}
+	writeString(w, "</table>\n</body></html>")
+}
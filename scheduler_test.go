@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A clock for the scheduler that only moves when told to.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func TestReserve(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	s := newScheduler(clock.now)
+	alice := s.register("Alice", editInterval, nil)
+	alice2 := s.register("Alice", editInterval, nil)
+	bot := s.register("Bot", time.Second, nil)
+	tests := []struct {
+		st      *jobStatus
+		advance time.Duration // Before reserving.
+		pause   time.Duration // Tool-wide pause before reserving.
+		want    time.Duration // Slot, from start.
+	}{
+		{alice, 0, 0, 0},
+		// The tool-wide interval separates different users.
+		{bot, 0, 0, time.Second},
+		{bot, 0, 0, 2 * time.Second},
+		// Two jobs for one user share the user's interval.
+		{alice2, 0, 0, editInterval},
+		{alice, 0, 0, 2 * editInterval},
+		// Slots are handed out in order, so Bot waits behind Alice.
+		{bot, 0, 0, 2*editInterval + time.Second},
+		// A slot is never in the past.
+		{bot, 20 * time.Second, 0, 20 * time.Second},
+		// A pause holds back every user.
+		{bot, 0, 30 * time.Second, 50 * time.Second},
+		{alice, 0, 0, 51 * time.Second},
+		// A shorter pause doesn't shorten a longer one.
+		{bot, 0, 10 * time.Second, 52 * time.Second},
+	}
+	for i, test := range tests {
+		clock.t = clock.t.Add(test.advance)
+		if test.pause > 0 {
+			s.pause(test.pause)
+		}
+		if got := s.reserve(test.st).Sub(start); got != test.want {
+			t.Errorf("reservation %d for %s at %v = %v, want %v", i, test.st.user, clock.t.Sub(start), got, test.want)
+		}
+	}
+}
+
+func TestPauseUser(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	s := newScheduler(clock.now)
+	alice := s.register("Alice", editInterval, nil)
+	bot := s.register("Bot", time.Second, nil)
+	s.pauseUser("Alice", time.Minute)
+	if got := s.reserve(bot).Sub(start); got != 0 {
+		t.Errorf("another user's backoff delayed Bot to %v", got)
+	}
+	if got := s.reserve(alice).Sub(start); got != time.Minute {
+		t.Errorf("Alice's backoff gave a slot at %v, want %v", got, time.Minute)
+	}
+	s.unregister(alice)
+	s.unregister(bot)
+	if len(s.jobs) != 0 || len(s.userNext) != 2 {
+		t.Errorf("after unregistering, %d jobs and %d users are kept, want 0 and 2 with future slots", len(s.jobs), len(s.userNext))
+	}
+	clock.t = clock.t.Add(2 * time.Minute)
+	s.unregister(s.register("Carol", editInterval, nil))
+	if len(s.userNext) != 0 {
+		t.Errorf("%d users kept after their slots passed, want 0", len(s.userNext))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{"Mon, 01 Jan 2024 00:00:30 GMT", 30 * time.Second},
+		{"Sun, 31 Dec 2023 23:59:00 GMT", 0},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.header, now); got != test.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newScheduler((&testClock{start}).now)
+	client := &http.Client{Transport: retryAfterTransport{http.DefaultTransport, s}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := s.reserve(s.register("Alice", editInterval, nil)).Sub(start); got != 30*time.Second {
+		t.Errorf("after Retry-After: 30, the next slot is at %v, want 30s", got)
+	}
+}
+
+func TestStatusHandlerAnonymous(t *testing.T) {
+	st := editScheduler.register("Alice", editInterval, make(chan chan *prepared, 3))
+	defer editScheduler.unregister(st)
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", statusRelative, nil))
+	page := w.Body.String()
+	if !strings.Contains(page, "1 jobs running") {
+		t.Errorf("status page doesn't count the job: %s", page)
+	}
+	if strings.Contains(page, "Alice") {
+		t.Errorf("status page shows a user's name without logging in: %s", page)
+	}
+}
+
+func TestDescribeRates(t *testing.T) {
+	defer func(policies []ratePolicy) { ratePolicies = policies }(ratePolicies)
+	tests := []struct {
+		policies []ratePolicy
+		want     string
+	}{
+		{nil, "Edits are limited to one per 5 seconds per user."},
+		{[]ratePolicy{{"bot", time.Second}, {"flood", time.Second}}, "Edits are limited to one per 5 seconds per user, or one per second for members of the bot or flood groups."},
+		{[]ratePolicy{{"bot", time.Second}, {"flood", 2 * time.Second}}, "Edits are limited to one per 5 seconds per user, or one per second for members of the bot group, or one per 2 seconds for members of the flood group."},
+		{[]ratePolicy{{"bot", 1500 * time.Millisecond}}, "Edits are limited to one per 5 seconds per user, or one per 1.5s for members of the bot group."},
+	}
+	for _, test := range tests {
+		ratePolicies = test.policies
+		if got := describeRates(); got != test.want {
+			t.Errorf("describeRates with %v = %q, want %q", test.policies, got, test.want)
+		}
+	}
+}
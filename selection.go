@@ -0,0 +1,436 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonholmquist/jason"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of the "select" form field, for the ways of choosing which
+// files to process.
+const (
+	selectRange    = "range"
+	selectCategory = "category"
+	selectList     = "list"
+	selectPage     = "page"
+	selectSearch   = "search"
+	selectUploads  = "uploads"
+)
+
+// The maximum number of titles per query for normal users.
+const titlesBatchSize = 50
+
+// Limit on subcategory depth, to keep runaway category trees in check.
+const maxDepth = 5
+
+func categoryParam(param string) (string, error) {
+	categoryPrefix := "Category:"
+	badChars := "|"
+	param = strings.TrimPrefix(param, commonsWiki)
+	if strings.ContainsAny(param, badChars) {
+		return "", errors.New("Category names may not contain the characters " + badChars)
+	}
+	if len(param) == 0 {
+		return param, nil
+	}
+	if !strings.HasPrefix(param, categoryPrefix) {
+		param = categoryPrefix + param
+	}
+	return param, nil
+}
+
+func depthParam(param string) (int, error) {
+	if param == "" {
+		return 0, nil
+	}
+	depth, err := strconv.Atoi(param)
+	if err != nil || depth < 0 || depth > maxDepth {
+		return 0, errors.New("Subcategory depth should be a number from 0 to " + strconv.Itoa(maxDepth) + ".")
+	}
+	return depth, nil
+}
+
+// Find a category and its subcategories to the given depth, in
+// breadth-first order. Each category is only listed once, even if the
+// category graph has cycles.
+func subcategories(category string, depth int, client *mwclient.Client) ([]string, error) {
+	result := []string{category}
+	seen := map[string]bool{category: true}
+	level := []string{category}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		var next []string
+		for _, parent := range level {
+			query := client.NewQuery(params.Values{
+				"list":    "categorymembers",
+				"cmtitle": parent,
+				"cmtype":  "subcat",
+				"cmlimit": "max",
+			})
+			for query.Next() {
+				members, err := query.Resp().GetObjectArray("query", "categorymembers")
+				if err != nil {
+					return nil, err
+				}
+				for _, member := range members {
+					title, err := member.GetString("title")
+					if err != nil {
+						return nil, err
+					}
+					if !seen[title] {
+						seen[title] = true
+						result = append(result, title)
+						next = append(next, title)
+					}
+				}
+			}
+			if query.Err() != nil {
+				return nil, query.Err()
+			}
+		}
+		level = next
+	}
+	return result, nil
+}
+
+func processCategories(ctx context.Context, categories []string, opts *options, client *mwclient.Client, w http.ResponseWriter) {
+	j := startJob(ctx, opts, client, w)
+	if j == nil {
+		return
+	}
+	j.run(func() {
+		for _, category := range categories {
+			ok := j.processQuery(params.Values{
+				"generator":    "categorymembers",
+				"gcmtitle":     category,
+				"gcmnamespace": "6",
+				"gcmtype":      "file",
+				"gcmlimit":     strconv.Itoa(batchSize),
+			}, j.opts)
+			if !ok {
+				return
+			}
+		}
+	})
+	j.finish()
+}
+
+// Parse a list of file names or URLs, one per line.
+func titlesParam(param string) ([]string, error) {
+	var titles []string
+	for i, line := range strings.Split(param, "\n") {
+		title, err := fileParam(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+		if title != "" {
+			titles = append(titles, title)
+		}
+	}
+	return titles, nil
+}
+
+// Get imageinfo for a batch of titles, returning the page objects in
+// the order requested. Pages that weren't returned are nil.
+func getTitlesBatch(titles []string, client *mwclient.Client) ([]*jason.Object, error) {
+	params := params.Values{
+		"action": "query",
+		"titles": strings.Join(titles, "|"),
+	}
+	addInfoParams(params)
+	json, err := client.Get(params)
+	if _, isWarning := err.(mwclient.APIWarnings); err != nil && !isWarning {
+		return nil, err
+	}
+	// Requested titles may have been normalized, e.g., by
+	// capitalizing the first letter.
+	normalized := make(map[string]string)
+	if list, err := json.GetObjectArray("query", "normalized"); err == nil {
+		for _, item := range list {
+			from, err1 := item.GetString("from")
+			to, err2 := item.GetString("to")
+			if err1 == nil && err2 == nil {
+				normalized[from] = to
+			}
+		}
+	}
+	pages, err := json.GetObjectArray("query", "pages")
+	if err != nil {
+		return nil, err
+	}
+	byTitle := make(map[string]*jason.Object)
+	for _, page := range pages {
+		title, err := page.GetString("title")
+		if err == nil {
+			byTitle[title] = page
+		}
+	}
+	result := make([]*jason.Object, len(titles))
+	for i, title := range titles {
+		if to, ok := normalized[title]; ok {
+			title = to
+		}
+		result[i] = byTitle[title]
+	}
+	return result, nil
+}
+
+func isMissing(page *jason.Object) bool {
+	missing, _ := page.GetBoolean("missing")
+	invalid, _ := page.GetBoolean("invalid")
+	return missing || invalid
+}
+
+// Process a list of titles in the given order.
+func processList(ctx context.Context, titles []string, opts *options, client *mwclient.Client, w http.ResponseWriter) {
+	j := startJob(ctx, opts, client, w)
+	if j == nil {
+		return
+	}
+	j.run(func() {
+		j.processTitles(titles)
+	})
+	j.finish()
+}
+
+// Process titles in batches. Returns false if the job was cancelled.
+func (j *job) processTitles(titles []string) bool {
+	for start := 0; start < len(titles); start += titlesBatchSize {
+		end := start + titlesBatchSize
+		if end > len(titles) {
+			end = len(titles)
+		}
+		batch := titles[start:end]
+		pages, err := getTitlesBatch(batch, j.client)
+		if err != nil {
+			if !j.note("Query returned an error: " + html.EscapeString(err.Error()) + "<br>\n") {
+				return false
+			}
+			continue
+		}
+		for i, page := range pages {
+			if page == nil || isMissing(page) {
+				if !j.finished(batch[i], outcomeFailed, "file not found.") {
+					return false
+				}
+				continue
+			}
+			if !j.processPage(page, j.opts) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Domains of Wikimedia wikis that pages may be taken from.
+var wikimediaDomains = []string{
+	"wikipedia.org",
+	"wikimedia.org",
+	"wiktionary.org",
+	"wikibooks.org",
+	"wikinews.org",
+	"wikiquote.org",
+	"wikisource.org",
+	"wikiversity.org",
+	"wikivoyage.org",
+	"wikidata.org",
+	"mediawiki.org",
+}
+
+const commonsHost = "commons.wikimedia.org"
+
+// Parse a page title or the URL of a page on a Wikimedia wiki,
+// returning the wiki host name and the page title.
+func pageParam(param string) (string, string, error) {
+	if !strings.HasPrefix(param, "https://") && !strings.HasPrefix(param, "http://") {
+		if strings.Contains(param, "|") {
+			return "", "", errors.New("Page titles may not contain the character |")
+		}
+		return commonsHost, param, nil
+	}
+	u, err := url.Parse(param)
+	if err != nil {
+		return "", "", err
+	}
+	host := strings.ToLower(u.Hostname())
+	wikimedia := false
+	for _, domain := range wikimediaDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			wikimedia = true
+			break
+		}
+	}
+	if !wikimedia {
+		return "", "", errors.New("Pages must be on a Wikimedia wiki.")
+	}
+	page := u.Query().Get("title")
+	if page == "" {
+		if !strings.HasPrefix(u.Path, "/wiki/") {
+			return "", "", errors.New("Can't find the page title in the URL.")
+		}
+		page = strings.TrimPrefix(u.Path, "/wiki/")
+	}
+	return host, strings.ReplaceAll(page, "_", " "), nil
+}
+
+// Find the files used on a page, including those in galleries, as
+// Commons file titles. The client is used for pages on Commons; other
+// wikis are queried anonymously.
+func pageImages(wikiHost, page string, client *mwclient.Client) ([]string, error) {
+	if wikiHost != commonsHost {
+		var err error
+		client, err = mwclient.New("https://"+wikiHost+"/w/api.php", "dtz; User:Ghouston")
+		if err != nil {
+			return nil, err
+		}
+		client.Maxlag.On = true
+	}
+	query := client.NewQuery(params.Values{
+		"titles":  page,
+		"prop":    "images",
+		"imlimit": "max",
+	})
+	var titles []string
+	for query.Next() {
+		pages, err := query.Resp().GetObjectArray("query", "pages")
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range pages {
+			if isMissing(obj) {
+				return nil, errors.New("Page not found.")
+			}
+			images, err := obj.GetObjectArray("images")
+			if err != nil {
+				// Not present in continuation batches for
+				// other properties.
+				continue
+			}
+			for _, image := range images {
+				title, err := image.GetString("title")
+				if err != nil {
+					return nil, err
+				}
+				// The file namespace may have a local name
+				// on other wikis.
+				if colon := strings.Index(title, ":"); colon >= 0 {
+					title = "File:" + title[colon+1:]
+				}
+				titles = append(titles, title)
+			}
+		}
+	}
+	if query.Err() != nil {
+		return nil, query.Err()
+	}
+	return titles, nil
+}
+
+// Find the total number of files matching a search.
+func searchTotal(search string, client *mwclient.Client) (int64, error) {
+	params := params.Values{
+		"action":      "query",
+		"list":        "search",
+		"srsearch":    search,
+		"srnamespace": "6",
+		"srlimit":     "1",
+		"srinfo":      "totalhits",
+		"srprop":      "",
+	}
+	json, err := client.Get(params)
+	if _, isWarning := err.(mwclient.APIWarnings); err != nil && !isWarning {
+		return 0, err
+	}
+	return json.GetInt64("query", "searchinfo", "totalhits")
+}
+
+func processSearch(ctx context.Context, search string, total int64, opts *options, client *mwclient.Client, w http.ResponseWriter) {
+	fmt.Fprintf(w, "<p>The search found %d files.</p>\n", total)
+	j := startJob(ctx, opts, client, w)
+	if j == nil {
+		return
+	}
+	j.run(func() {
+		j.processQuery(params.Values{
+			"generator":    "search",
+			"gsrsearch":    search,
+			"gsrnamespace": "6",
+			"gsrlimit":     strconv.Itoa(batchSize),
+		}, j.opts)
+	})
+	j.finish()
+}
+
+func userParam(param string) string {
+	param = strings.TrimPrefix(param, commonsWiki)
+	param = strings.TrimPrefix(param, "User:")
+	return strings.ReplaceAll(param, "_", " ")
+}
+
+const apiTimestampFormat = "2006-01-02T15:04:05Z"
+
+// Parse a time from the form, as a wall time in UTC. If end is true,
+// a date without a time refers to the end of the day. Returns the
+// zero time if param is empty.
+func timeParam(param string, end bool) (time.Time, error) {
+	if param == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", param); err == nil {
+		if end {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return t, nil
+	}
+	for _, format := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02T15:04:05", apiTimestampFormat} {
+		if t, err := time.Parse(format, param); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Times should have the format 2023-03-01 or 2023-03-01 14:30.")
+}
+
+// Parse an upload time in UTC, returning it in the format used by the
+// API.
+func timestampParam(param string, end bool) (string, error) {
+	t, err := timeParam(param, end)
+	if err != nil || t.IsZero() {
+		return "", err
+	}
+	return t.Format(apiTimestampFormat), nil
+}
+
+// Interpret the wall time of t in another location.
+func wallTimeIn(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// Check that a user exists, returning the canonical form of the name.
+func checkUploader(user string, client *mwclient.Client) (string, error) {
+	params := params.Values{
+		"action":  "query",
+		"list":    "users",
+		"ususers": user,
+	}
+	json, err := client.Get(params)
+	if _, isWarning := err.(mwclient.APIWarnings); err != nil && !isWarning {
+		return "", err
+	}
+	users, err := json.GetObjectArray("query", "users")
+	if err != nil {
+		return "", err
+	}
+	if len(users) == 0 || isMissing(users[0]) {
+		return "", errors.New("User " + user + " not found.")
+	}
+	return users[0].GetString("name")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A client for a fake API that answers each request with respond.
+func testClient(t *testing.T, respond func(r *http.Request) interface{}) *mwclient.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		json.NewEncoder(w).Encode(respond(r))
+	}))
+	t.Cleanup(server.Close)
+	client, err := mwclient.New(server.URL, "dtz test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestCategoryParam(t *testing.T) {
+	tests := []struct {
+		param, want string
+		fails       bool
+	}{
+		{"", "", false},
+		{"Trip 2019", "Category:Trip 2019", false},
+		{"Category:Trip 2019", "Category:Trip 2019", false},
+		{commonsWiki + "Category:Trip 2019", "Category:Trip 2019", false},
+		{"Trip|2019", "", true},
+	}
+	for _, test := range tests {
+		got, err := categoryParam(test.param)
+		if (err != nil) != test.fails || got != test.want {
+			t.Errorf("categoryParam(%q) = %q, %v, want %q (error %v)", test.param, got, err, test.want, test.fails)
+		}
+	}
+	for _, param := range []string{"-1", "6", "two"} {
+		if _, err := depthParam(param); err == nil {
+			t.Errorf("depthParam(%q) succeeded, want an error", param)
+		}
+	}
+	if depth, err := depthParam(""); err != nil || depth != 0 {
+		t.Errorf("depthParam(\"\") = %d, %v, want 0", depth, err)
+	}
+}
+
+func TestSubcategories(t *testing.T) {
+	// B and A are subcategories of each other.
+	tree := map[string][]string{
+		"Category:A": {"Category:B", "Category:C"},
+		"Category:B": {"Category:C", "Category:A"},
+		"Category:C": {"Category:D"},
+		"Category:D": {"Category:E"},
+	}
+	client := testClient(t, func(r *http.Request) interface{} {
+		members := []map[string]string{}
+		for _, title := range tree[r.Form.Get("cmtitle")] {
+			members = append(members, map[string]string{"title": title})
+		}
+		return map[string]interface{}{"query": map[string]interface{}{"categorymembers": members}}
+	})
+	tests := []struct {
+		depth int
+		want  []string
+	}{
+		{0, []string{"Category:A"}},
+		{1, []string{"Category:A", "Category:B", "Category:C"}},
+		{2, []string{"Category:A", "Category:B", "Category:C", "Category:D"}},
+		{5, []string{"Category:A", "Category:B", "Category:C", "Category:D", "Category:E"}},
+	}
+	for _, test := range tests {
+		got, err := subcategories("Category:A", test.depth, client)
+		if err != nil {
+			t.Errorf("subcategories at depth %d failed: %v", test.depth, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("subcategories at depth %d = %v, want %v", test.depth, got, test.want)
+		}
+	}
+}
+
+func TestTimeParam(t *testing.T) {
+	tests := []struct {
+		param string
+		end   bool
+		want  time.Time
+	}{
+		{"", false, time.Time{}},
+		{"2019-05-01", false, time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2019-05-01", true, time.Date(2019, 5, 1, 23, 59, 59, 0, time.UTC)},
+		{"2019-05-01 14:30", true, time.Date(2019, 5, 1, 14, 30, 0, 0, time.UTC)},
+		{"2019-05-01T14:30:15", false, time.Date(2019, 5, 1, 14, 30, 15, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := timeParam(test.param, test.end)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("timeParam(%q, %v) = %v, %v, want %v", test.param, test.end, got, err, test.want)
+		}
+	}
+	if _, err := timeParam("1 May 2019", false); err == nil {
+		t.Errorf("timeParam accepted a date in words")
+	}
+}